@@ -13,6 +13,8 @@
 
 package consul
 
+import "time"
+
 // Register configuration.
 type Register struct {
 	Interval                       string            `json:"interval,omitempty" yaml:"interval,omitempty"`                                                   // The time period between two health checks.
@@ -31,10 +33,147 @@ type Config struct {
 	Services         []string           `json:"services,omitempty" yaml:"services,omitempty"`                   // Registration service required.
 	Register         Register           `json:"register,omitempty" yaml:"register,omitempty"`                   // Global registration configuration.
 	ServicesRegister []*ServiceRegister `json:"services_register,omitempty" yaml:"services_register,omitempty"` // ServiceRegister enables different configurations for different services.
+	// Discovery configuration.
+	Discovery struct {
+		// AddressTag is the tagged address used when the service is registered without an address,
+		// such as lan, wan, lan_ipv4. The node address is used if it is empty or does not exist.
+		AddressTag string `json:"address_tag,omitempty" yaml:"address_tag,omitempty"`
+		// IdleTTL is how long a service can stay without lookups before it is no longer watched, 0 means never.
+		IdleTTL time.Duration `json:"idle_ttl,omitempty" yaml:"idle_ttl,omitempty"`
+		// InitialSyncTimeout is how long the first lookup of a service waits for the first result of its watcher
+		// before querying consul directly.
+		InitialSyncTimeout time.Duration `json:"initial_sync_timeout,omitempty" yaml:"initial_sync_timeout,omitempty"`
+		// NegativeTTL is how long the failure of looking up a service is returned without querying consul again.
+		NegativeTTL time.Duration `json:"negative_ttl,omitempty" yaml:"negative_ttl,omitempty"`
+		// Consistency is the consistency mode of reading from consul, one of default, stale and consistent.
+		Consistency string `json:"consistency,omitempty" yaml:"consistency,omitempty"`
+		// MaxAge is the max age of stale results and results cached by the consul agent.
+		MaxAge time.Duration `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+		// UseCache reads the results from the cache of the consul agent.
+		UseCache bool `json:"use_cache,omitempty" yaml:"use_cache,omitempty"`
+		// Near is the node which the nodes are sorted by the estimated rtt from, _agent means the local agent.
+		Near string `json:"near,omitempty" yaml:"near,omitempty"`
+		// WaitTime is the max time a blocking query waits for changes.
+		WaitTime time.Duration `json:"wait_time,omitempty" yaml:"wait_time,omitempty"`
+		// MaxConcurrentQueries is the max number of concurrent blocking queries.
+		MaxConcurrentQueries int `json:"max_concurrent_queries,omitempty" yaml:"max_concurrent_queries,omitempty"`
+		// RetryInterval and MaxRetryInterval are the initial and max interval of retrying failed blocking queries.
+		RetryInterval    time.Duration `json:"retry_interval,omitempty" yaml:"retry_interval,omitempty"`
+		MaxRetryInterval time.Duration `json:"max_retry_interval,omitempty" yaml:"max_retry_interval,omitempty"`
+		// PreparedQueryInterval is the interval of polling the services resolved by prepared queries.
+		PreparedQueryInterval time.Duration `json:"prepared_query_interval,omitempty" yaml:"prepared_query_interval,omitempty"`
+		// MinQueryInterval is the min interval between two blocking queries of a service.
+		MinQueryInterval time.Duration `json:"min_query_interval,omitempty" yaml:"min_query_interval,omitempty"`
+		// MaxStaleness is how long the last known nodes are served while consul is unreachable, 0 means forever.
+		MaxStaleness time.Duration `json:"max_staleness,omitempty" yaml:"max_staleness,omitempty"`
+		// SnapshotDir is the directory of the on-disk snapshot of discovered nodes, empty means no snapshot.
+		SnapshotDir string `json:"snapshot_dir,omitempty" yaml:"snapshot_dir,omitempty"`
+		// SnapshotInterval is the interval of saving the snapshot.
+		SnapshotInterval time.Duration `json:"snapshot_interval,omitempty" yaml:"snapshot_interval,omitempty"`
+		// SnapshotMaxAge is the max age of the nodes loaded from the snapshot.
+		SnapshotMaxAge time.Duration `json:"snapshot_max_age,omitempty" yaml:"snapshot_max_age,omitempty"`
+		// PreloadServices are the services looked up at Setup, so that the first call does not wait for consul.
+		PreloadServices []string `json:"preload_services,omitempty" yaml:"preload_services,omitempty"`
+		// PreloadClientServices preloads the services in client.service whose target is consul:// as well.
+		PreloadClientServices bool `json:"preload_client_services,omitempty" yaml:"preload_client_services,omitempty"`
+		// PreloadTimeout is the max time Setup waits for preloading.
+		PreloadTimeout time.Duration `json:"preload_timeout,omitempty" yaml:"preload_timeout,omitempty"`
+		// PreloadRequired fails Setup if a preloaded service has no healthy nodes, otherwise a warning is logged.
+		PreloadRequired bool `json:"preload_required,omitempty" yaml:"preload_required,omitempty"`
+	} `json:"discovery,omitempty" yaml:"discovery,omitempty"`
 	// Selector configuration.
 	Selector struct {
 		LoadBalancer string `json:"loadBalancer,omitempty" yaml:"loadBalancer,omitempty"` // load balancing strategy
+		Nearest      int    `json:"nearest,omitempty" yaml:"nearest,omitempty"`           // select among the nearest n nodes
+		// CircuitBreaker configuration of each node.
+		CircuitBreaker CircuitBreaker `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+		// OutlierDetection configuration of each service.
+		OutlierDetection OutlierDetection `json:"outlier_detection,omitempty" yaml:"outlier_detection,omitempty"`
+		// RoutingRules filter the nodes by the caller in order.
+		RoutingRules []RoutingRule `json:"routing_rules,omitempty" yaml:"routing_rules,omitempty"`
+		// Locality configuration.
+		Locality Locality `json:"locality,omitempty" yaml:"locality,omitempty"`
+		// SlowStart configuration of new nodes.
+		SlowStart SlowStart `json:"slow_start,omitempty" yaml:"slow_start,omitempty"`
+		// Services are the configuration of each callee keyed by the callee name, which overrides the global one.
+		Services map[string]*SelectorService `json:"services,omitempty" yaml:"services,omitempty"`
 	}
+	// Clusters are other consul clusters, each registers its own selector consul-<name>.
+	Clusters []*Cluster `json:"clusters,omitempty" yaml:"clusters,omitempty"`
+}
+
+// Cluster configuration of a named consul cluster, the clusters nested in it are ignored.
+type Cluster struct {
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"` // Name of the cluster.
+	Config `yaml:",inline"`
+}
+
+// CircuitBreaker configuration, zero values use the defaults.
+type CircuitBreaker struct {
+	Enabled             bool          `json:"enabled,omitempty" yaml:"enabled,omitempty"`                           // Whether to enable the circuit breaker.
+	ErrorRate           float64       `json:"error_rate,omitempty" yaml:"error_rate,omitempty"`                     // Error rate in the window to open the breaker.
+	MinRequests         int           `json:"min_requests,omitempty" yaml:"min_requests,omitempty"`                 // Min requests in the window to check the error rate.
+	ConsecutiveFailures int           `json:"consecutive_failures,omitempty" yaml:"consecutive_failures,omitempty"` // Consecutive failures to open the breaker.
+	SlowThreshold       time.Duration `json:"slow_threshold,omitempty" yaml:"slow_threshold,omitempty"`             // Calls slower than it are failures.
+	Window              time.Duration `json:"window,omitempty" yaml:"window,omitempty"`                             // Window of counting the error rate.
+	RecoveryWindow      time.Duration `json:"recovery_window,omitempty" yaml:"recovery_window,omitempty"`           // How long the breaker stays open before probing.
+}
+
+// OutlierDetection configuration, zero values use the defaults.
+type OutlierDetection struct {
+	Enabled                bool          `json:"enabled,omitempty" yaml:"enabled,omitempty"`                                     // Whether to enable the outlier detection.
+	Interval               time.Duration `json:"interval,omitempty" yaml:"interval,omitempty"`                                   // Interval of detecting outliers.
+	MinRequests            int           `json:"min_requests,omitempty" yaml:"min_requests,omitempty"`                           // Min requests of a node in the interval.
+	MinHosts               int           `json:"min_hosts,omitempty" yaml:"min_hosts,omitempty"`                                 // Min nodes with enough requests.
+	SuccessRateStdevFactor float64       `json:"success_rate_stdev_factor,omitempty" yaml:"success_rate_stdev_factor,omitempty"` // Stdev factor of the success rate.
+	LatencyFactor          float64       `json:"latency_factor,omitempty" yaml:"latency_factor,omitempty"`                       // Factor of the median latency.
+	BaseEjectionTime       time.Duration `json:"base_ejection_time,omitempty" yaml:"base_ejection_time,omitempty"`               // Ejection time of the first ejection.
+	MaxEjectionTime        time.Duration `json:"max_ejection_time,omitempty" yaml:"max_ejection_time,omitempty"`                 // Max ejection time.
+	MaxEjectionPercent     int           `json:"max_ejection_percent,omitempty" yaml:"max_ejection_percent,omitempty"`           // Max percent of nodes ejected.
+}
+
+// RoutingRule keeps the nodes whose metadata value of the meta key equals the value of the caller field.
+type RoutingRule struct {
+	MetaKey  string `json:"meta_key,omitempty" yaml:"meta_key,omitempty"` // Key of the node metadata.
+	Source   string `json:"source,omitempty" yaml:"source,omitempty"`     // Caller field, such as source_env.
+	Fallback string `json:"fallback,omitempty" yaml:"fallback,omitempty"` // Policy when no node matches, all or fail.
+}
+
+// Locality configuration of locality-aware load balancing.
+type Locality struct {
+	Enabled    bool    `json:"enabled,omitempty" yaml:"enabled,omitempty"`       // Whether to enable locality-aware load balancing.
+	Zone       string  `json:"zone,omitempty" yaml:"zone,omitempty"`             // Zone of the caller, CONSUL_ZONE by default.
+	Datacenter string  `json:"datacenter,omitempty" yaml:"datacenter,omitempty"` // Datacenter of the caller, CONSUL_DATACENTER by default.
+	ZoneKey    string  `json:"zone_key,omitempty" yaml:"zone_key,omitempty"`     // Key of the zone in the node metadata.
+	Threshold  float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`   // Healthy ratio below which the traffic spills over.
+}
+
+// SlowStart configuration, the weights of new nodes ramp up from the min weight ratio in the window.
+type SlowStart struct {
+	Enabled        bool          `json:"enabled,omitempty" yaml:"enabled,omitempty"`                   // Whether to enable slow start.
+	Window         time.Duration `json:"window,omitempty" yaml:"window,omitempty"`                     // How long the ramp up takes.
+	MinWeightRatio float64       `json:"min_weight_ratio,omitempty" yaml:"min_weight_ratio,omitempty"` // Ratio of the weight to start from.
+	Curve          string        `json:"curve,omitempty" yaml:"curve,omitempty"`                       // linear or exponential.
+}
+
+// SelectorService configuration of a callee, zero values use the global configuration.
+type SelectorService struct {
+	LoadBalancer   string            `json:"loadBalancer,omitempty" yaml:"loadBalancer,omitempty"`       // load balancing strategy
+	Tags           []string          `json:"tags,omitempty" yaml:"tags,omitempty"`                       // Tags the nodes must have.
+	Metadata       map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`               // Metadata the nodes must have.
+	PanicThreshold float64           `json:"panic_threshold,omitempty" yaml:"panic_threshold,omitempty"` // Healthy ratio below which all nodes are selected.
+	// CircuitBreaker configuration of the callee, nil means the global one.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+	// Discovery configuration of the callee.
+	Discovery ServiceDiscovery `json:"discovery,omitempty" yaml:"discovery,omitempty"`
+}
+
+// ServiceDiscovery discovery configuration of a callee, zero values use the global configuration.
+type ServiceDiscovery struct {
+	Consistency string        `json:"consistency,omitempty" yaml:"consistency,omitempty"` // Consistency mode of reading from consul.
+	MaxAge      time.Duration `json:"max_age,omitempty" yaml:"max_age,omitempty"`         // Max age of stale and cached results.
+	UseCache    *bool         `json:"use_cache,omitempty" yaml:"use_cache,omitempty"`     // Whether to use the cache of the consul agent.
+	WaitTime    time.Duration `json:"wait_time,omitempty" yaml:"wait_time,omitempty"`     // Max time a blocking query waits.
 }
 
 // ServiceRegister enables different configurations for different services.
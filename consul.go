@@ -15,10 +15,17 @@
 package consul
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/consul/api"
+	trpc "trpc.group/trpc-go/trpc-go"
+	"trpc.group/trpc-go/trpc-go/log"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
 	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
 	"trpc.group/trpc-go/trpc-go/plugin"
@@ -36,24 +43,55 @@ func init() {
 const (
 	pluginType = "naming"
 	pluginName = "consul"
+
+	closeTimeout   = 3 * time.Second
+	preloadTimeout = 3 * time.Second
 )
 
 // Plugin structure.
-type Plugin struct{}
+type Plugin struct {
+	// Discoveries of the consul clusters set up, which are closed by Close.
+	discoveries []*discovery.Discovery
+}
 
 // Type for plugin type.
 func (p *Plugin) Type() string {
 	return pluginType
 }
 
-// Setup for Setting up.
+// Setup for Setting up. The default cluster registers the selector consul, and each named cluster registers
+// its own selector consul-<name> with its own client, discovery and registry.
 func (p *Plugin) Setup(name string, decoder plugin.Decoder) error {
 	cfg := Config{}
 	err := decoder.Decode(&cfg)
 	if err != nil {
 		return err
 	}
+	names := make(map[string]bool, len(cfg.Clusters))
+	for _, c := range cfg.Clusters {
+		if c == nil || c.Name == "" {
+			return errors.New("consul cluster without name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate consul cluster %s", c.Name)
+		}
+		names[c.Name] = true
+	}
 
+	if err := p.setupCluster("", &cfg); err != nil {
+		return err
+	}
+	for _, c := range cfg.Clusters {
+		if err := p.setupCluster(c.Name, &c.Config); err != nil {
+			return fmt.Errorf("consul cluster %s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// setupCluster sets up the client, discovery, registry and selector of the consul cluster,
+// the default cluster is the one without name, whose instances are saved in the default globals.
+func (p *Plugin) setupCluster(name string, cfg *Config) error {
 	clientConfig := api.DefaultNonPooledConfig()
 	clientConfig.Address = cfg.Address
 	runtime.SetFinalizer(clientConfig.Transport, func(tr *http.Transport) {
@@ -64,12 +102,66 @@ func (p *Plugin) Setup(name string, decoder plugin.Decoder) error {
 	if err != nil {
 		return err
 	}
-	servicesOptions := make(map[string]*registry.ServiceOptions, 0)
-	for _, register := range cfg.ServicesRegister {
-		servicesOptions[register.Service] = convertServiceRegister2ServiceOptions(&cfg, register)
+
+	// Check selector options before starting discovery.
+	rules := make([]selector.RoutingRule, 0, len(cfg.Selector.RoutingRules))
+	for _, r := range cfg.Selector.RoutingRules {
+		rule := selector.RoutingRule{MetaKey: r.MetaKey, Source: r.Source, Fallback: r.Fallback}
+		if err := rule.Check(); err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	var slowStart *selector.SlowStartOptions
+	if ss := cfg.Selector.SlowStart; ss.Enabled {
+		slowStart = &selector.SlowStartOptions{Window: ss.Window, MinWeightRatio: ss.MinWeightRatio, Curve: ss.Curve}
+		if err := slowStart.Check(); err != nil {
+			return err
+		}
+	}
+	selectorServices := make(map[string]*selector.ServiceOptions, len(cfg.Selector.Services))
+	discoveryServices := make(map[string]*discovery.ServiceOptions, len(cfg.Selector.Services))
+	for serviceName, service := range cfg.Selector.Services {
+		if service == nil {
+			continue
+		}
+		selectorServices[serviceName], discoveryServices[serviceName] = convertSelectorService(service)
 	}
 
+	// Set discovery.
+	adopts := []discovery.Option{
+		discovery.WithClient(c),
+		discovery.WithCluster(name),
+		discovery.WithAddressTag(cfg.Discovery.AddressTag),
+		discovery.WithIdleTTL(cfg.Discovery.IdleTTL),
+		discovery.WithInitialSyncTimeout(cfg.Discovery.InitialSyncTimeout),
+		discovery.WithNegativeTTL(cfg.Discovery.NegativeTTL),
+		discovery.WithConsistency(cfg.Discovery.Consistency),
+		discovery.WithMaxAge(cfg.Discovery.MaxAge),
+		discovery.WithUseCache(cfg.Discovery.UseCache),
+		discovery.WithNear(cfg.Discovery.Near),
+		discovery.WithWaitTime(cfg.Discovery.WaitTime),
+		discovery.WithMaxConcurrentQueries(cfg.Discovery.MaxConcurrentQueries),
+		discovery.WithRetryInterval(cfg.Discovery.RetryInterval, cfg.Discovery.MaxRetryInterval),
+		discovery.WithMinQueryInterval(cfg.Discovery.MinQueryInterval),
+		discovery.WithPreparedQueryInterval(cfg.Discovery.PreparedQueryInterval),
+		discovery.WithMaxStaleness(cfg.Discovery.MaxStaleness),
+		discovery.WithSnapshotDir(cfg.Discovery.SnapshotDir),
+		discovery.WithSnapshotInterval(cfg.Discovery.SnapshotInterval),
+		discovery.WithSnapshotMaxAge(cfg.Discovery.SnapshotMaxAge),
+		discovery.WithServicesOptions(discoveryServices),
+	}
+	d, err := discovery.New(adopts...)
+	if err != nil {
+		return err
+	}
+	p.discoveries = append(p.discoveries, d)
+
 	// Set registry.
+	servicesOptions := make(map[string]*registry.ServiceOptions, 0)
+	for _, register := range cfg.ServicesRegister {
+		servicesOptions[register.Service] = convertServiceRegister2ServiceOptions(cfg, register)
+	}
 	opts := []registry.Option{
 		registry.WithTimeout(cfg.Register.Timeout),
 		registry.WithInterval(cfg.Register.Interval),
@@ -82,33 +174,170 @@ func (p *Plugin) Setup(name string, decoder plugin.Decoder) error {
 		registry.WithDeRegisterCriticalServiceAfter(cfg.Register.DeregisterCriticalServiceAfter),
 		registry.WithServicesOptions(servicesOptions),
 	}
-	registry.DefaultRegistry = registry.New(opts...)
+	r := registry.New(opts...)
 	// Each service is registered separately.
 	for _, service := range cfg.Services {
-		tregistry.Register(service, registry.DefaultRegistry)
+		tregistry.Register(service, r)
 	}
 	for _, register := range cfg.ServicesRegister {
-		tregistry.Register(register.Service, registry.DefaultRegistry)
+		tregistry.Register(register.Service, r)
 	}
 
 	// Set select.
 	opt := []selector.Option{
+		selector.WithDiscovery(d),
 		selector.WithLoadBalancer(cfg.Selector.LoadBalancer),
+		selector.WithNearest(cfg.Selector.Nearest),
+		selector.WithRoutingRules(rules),
+		selector.WithServices(selectorServices),
+	}
+	if breaker := cfg.Selector.CircuitBreaker; breaker.Enabled {
+		opt = append(opt, selector.WithCircuitBreaker(convertCircuitBreaker(&breaker)))
+	}
+	if slowStart != nil {
+		opt = append(opt, selector.WithSlowStart(*slowStart))
+	}
+	if l := cfg.Selector.Locality; l.Enabled {
+		opt = append(opt, selector.WithLocality(selector.LocalityOptions{
+			Zone:       l.Zone,
+			Datacenter: l.Datacenter,
+			ZoneKey:    l.ZoneKey,
+			Threshold:  l.Threshold,
+		}))
+	}
+	if outlier := cfg.Selector.OutlierDetection; outlier.Enabled {
+		opt = append(opt, selector.WithOutlierDetection(selector.OutlierDetectionOptions{
+			Interval:               outlier.Interval,
+			MinRequests:            outlier.MinRequests,
+			MinHosts:               outlier.MinHosts,
+			SuccessRateStdevFactor: outlier.SuccessRateStdevFactor,
+			LatencyFactor:          outlier.LatencyFactor,
+			BaseEjectionTime:       outlier.BaseEjectionTime,
+			MaxEjectionTime:        outlier.MaxEjectionTime,
+			MaxEjectionPercent:     outlier.MaxEjectionPercent,
+		}))
 	}
-	selector.DefaultSelector = selector.New(opt...)
-	tselector.Register(pluginName, selector.DefaultSelector)
+	s := selector.New(opt...)
+	scheme := clusterScheme(name)
+	tselector.Register(scheme, s)
 
-	// Set discovery.
-	adopts := []discovery.Option{
-		discovery.WithClient(c),
+	if name == "" {
+		discovery.DefaultDiscovery = d
+		registry.DefaultRegistry = r
+		selector.DefaultSelector = s
 	}
-	discovery.DefaultDiscovery, err = discovery.New(adopts...)
-	if err != nil {
+	return preload(cfg, scheme, d)
+}
+
+// clusterScheme returns the selector name of the consul cluster, which is the scheme of its targets.
+func clusterScheme(name string) string {
+	if name == "" {
+		return pluginName
+	}
+	return pluginName + "-" + name
+}
+
+// preload looks up the services to preload, the error is returned only if the preloading is required.
+func preload(cfg *Config, scheme string, d *discovery.Discovery) error {
+	serviceNames := preloadServices(cfg, scheme, trpc.GlobalConfig())
+	if len(serviceNames) == 0 {
+		return nil
+	}
+	timeout := cfg.Discovery.PreloadTimeout
+	if timeout <= 0 {
+		timeout = preloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := d.Preload(ctx, serviceNames...)
+	if err == nil {
+		return nil
+	}
+	if cfg.Discovery.PreloadRequired {
 		return err
 	}
+	log.Warnf("%s failed to preload services, err: %s", scheme, err)
 	return nil
 }
 
+// preloadServices returns the deduplicated services to preload, including the client services
+// whose target is of the scheme if it is configured.
+func preloadServices(cfg *Config, scheme string, globalConfig *trpc.Config) []string {
+	serviceNames := make([]string, 0, len(cfg.Discovery.PreloadServices))
+	seen := make(map[string]bool)
+	add := func(serviceName string) {
+		if serviceName == "" || seen[serviceName] {
+			return
+		}
+		seen[serviceName] = true
+		serviceNames = append(serviceNames, serviceName)
+	}
+	for _, serviceName := range cfg.Discovery.PreloadServices {
+		add(serviceName)
+	}
+	if !cfg.Discovery.PreloadClientServices || globalConfig == nil {
+		return serviceNames
+	}
+	prefix := scheme + "://"
+	for _, service := range globalConfig.Client.Service {
+		if service != nil && strings.HasPrefix(service.Target, prefix) {
+			add(strings.TrimPrefix(service.Target, prefix))
+		}
+	}
+	return serviceNames
+}
+
+// Close for closing the plugin, it stops watching all the consul clusters.
+func (p *Plugin) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	var firstErr error
+	for _, d := range p.discoveries {
+		if err := d.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.discoveries = nil
+	return firstErr
+}
+
+// convertCircuitBreaker converts CircuitBreaker to CircuitBreakerOptions.
+func convertCircuitBreaker(breaker *CircuitBreaker) selector.CircuitBreakerOptions {
+	return selector.CircuitBreakerOptions{
+		ErrorRate:           breaker.ErrorRate,
+		MinRequests:         breaker.MinRequests,
+		ConsecutiveFailures: breaker.ConsecutiveFailures,
+		SlowThreshold:       breaker.SlowThreshold,
+		Window:              breaker.Window,
+		RecoveryWindow:      breaker.RecoveryWindow,
+	}
+}
+
+// convertSelectorService converts SelectorService to the selector and discovery options of the callee,
+// the global configuration is used for those not configured.
+func convertSelectorService(service *SelectorService) (*selector.ServiceOptions, *discovery.ServiceOptions) {
+	so := &selector.ServiceOptions{
+		LoadBalancer:   service.LoadBalancer,
+		Tags:           service.Tags,
+		Metadata:       service.Metadata,
+		PanicThreshold: service.PanicThreshold,
+	}
+	if breaker := service.CircuitBreaker; breaker != nil {
+		if breaker.Enabled {
+			options := convertCircuitBreaker(breaker)
+			so.CircuitBreaker = &options
+		} else {
+			so.DisableCircuitBreaker = true
+		}
+	}
+	return so, &discovery.ServiceOptions{
+		Consistency: service.Discovery.Consistency,
+		MaxAge:      service.Discovery.MaxAge,
+		UseCache:    service.Discovery.UseCache,
+		WaitTime:    service.Discovery.WaitTime,
+	}
+}
+
 // convertServiceRegister2ServiceOptions converts ServiceRegister to ServiceOptions
 // and use the global configuration to overwrite the configuration that does not exist locally.
 func convertServiceRegister2ServiceOptions(cfg *Config, serviceRegister *ServiceRegister) *registry.ServiceOptions {
@@ -19,6 +19,10 @@ import (
 	. "github.com/glycerine/goconvey/convey"
 	"github.com/stretchr/testify/require"
 	trpc "trpc.group/trpc-go/trpc-go"
+	"trpc.group/trpc-go/trpc-go/client"
+	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+	"trpc.group/trpc-go/trpc-naming-consul/selector"
 	// register http codec to avoid panic when calling trpc.NewServer() without stub code
 	_ "trpc.group/trpc-go/trpc-go/http"
 )
@@ -89,3 +93,85 @@ func Test_convertServiceRegister2ServiceOptions(t *testing.T) {
 		So(options.DeregisterCriticalServiceAfter, ShouldEqual, "10m")
 	})
 }
+
+func Test_preloadServices(t *testing.T) {
+	Convey("预先寻址的服务", t, func() {
+		cfg := &Config{}
+		cfg.Discovery.PreloadServices = []string{"a", "b", "a"}
+		globalConfig := &trpc.Config{}
+		globalConfig.Client.Service = []*client.BackendConfig{
+			{ServiceName: "c", Target: "consul://c"},
+			{ServiceName: "d", Target: "ip://127.0.0.1:8000"},
+			{ServiceName: "b", Target: "consul://b"},
+			{ServiceName: "e"},
+		}
+		So(preloadServices(cfg, "consul", globalConfig), ShouldResemble, []string{"a", "b"})
+		cfg.Discovery.PreloadClientServices = true
+		So(preloadServices(cfg, "consul", globalConfig), ShouldResemble, []string{"a", "b", "c"})
+		So(preloadServices(&Config{}, "consul", globalConfig), ShouldBeEmpty)
+	})
+}
+
+func Test_convertSelectorService(t *testing.T) {
+	Convey("被调配置转换", t, func() {
+		so, do := convertSelectorService(&SelectorService{
+			LoadBalancer:   "round_robin",
+			Tags:           []string{"v2"},
+			PanicThreshold: 0.5,
+			CircuitBreaker: &CircuitBreaker{Enabled: true, ConsecutiveFailures: 3},
+			Discovery:      ServiceDiscovery{Consistency: "stale"},
+		})
+		So(so.LoadBalancer, ShouldEqual, "round_robin")
+		So(so.Tags, ShouldResemble, []string{"v2"})
+		So(so.PanicThreshold, ShouldEqual, 0.5)
+		So(so.CircuitBreaker.ConsecutiveFailures, ShouldEqual, 3)
+		So(so.DisableCircuitBreaker, ShouldBeFalse)
+		So(do.Consistency, ShouldEqual, "stale")
+
+		// The circuit breaker is disabled for the callee.
+		so, _ = convertSelectorService(&SelectorService{CircuitBreaker: &CircuitBreaker{}})
+		So(so.CircuitBreaker, ShouldBeNil)
+		So(so.DisableCircuitBreaker, ShouldBeTrue)
+		// The global circuit breaker is used.
+		so, _ = convertSelectorService(&SelectorService{})
+		So(so.CircuitBreaker, ShouldBeNil)
+		So(so.DisableCircuitBreaker, ShouldBeFalse)
+	})
+}
+
+type testDecoder struct {
+	cfg *Config
+}
+
+func (d *testDecoder) Decode(cfg interface{}) error {
+	*cfg.(*Config) = *d.cfg
+	return nil
+}
+
+func TestPlugin_Setup_clusters(t *testing.T) {
+	Convey("多个consul集群", t, func() {
+		cfg := &Config{Address: "127.0.0.1:8500"}
+		cfg.Clusters = []*Cluster{{Name: "infra", Config: Config{Address: "127.0.0.1:8501"}}}
+		p := &Plugin{}
+		So(p.Setup(pluginName, &testDecoder{cfg: cfg}), ShouldBeNil)
+		defer p.Close()
+		So(len(p.discoveries), ShouldEqual, 2)
+		So(discovery.DefaultDiscovery, ShouldEqual, p.discoveries[0])
+		So(tselector.Get(pluginName), ShouldEqual, selector.DefaultSelector)
+		s, ok := tselector.Get("consul-infra").(*selector.Selector)
+		So(ok, ShouldBeTrue)
+		So(s, ShouldNotEqual, selector.DefaultSelector)
+		So(s.Opts.Discovery, ShouldEqual, p.discoveries[1])
+		So(p.Close(), ShouldBeNil)
+		So(p.discoveries, ShouldBeEmpty)
+
+		cfg.Clusters = []*Cluster{{Name: "infra"}, {Name: "infra"}}
+		So(p.Setup(pluginName, &testDecoder{cfg: cfg}), ShouldNotBeNil)
+		cfg.Clusters = []*Cluster{{}}
+		So(p.Setup(pluginName, &testDecoder{cfg: cfg}), ShouldNotBeNil)
+	})
+	Convey("集群的selector名", t, func() {
+		So(clusterScheme(""), ShouldEqual, "consul")
+		So(clusterScheme("infra"), ShouldEqual, "consul-infra")
+	})
+}
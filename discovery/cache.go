@@ -14,18 +14,30 @@
 package discovery
 
 import (
+	"context"
+	"errors"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/consul/api"
+	"trpc.group/trpc-go/trpc-go/log"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
 )
 
 var (
 	emptyNodes = make([]*tregistry.Node, 0)
 )
 
+// defaultNegativeTTL is how long the failure of looking up a service is cached by default.
+const defaultNegativeTTL = 5 * time.Second
+
+// minEvictInterval is the min interval of evicting idle services, which keeps a tiny idle ttl from spinning.
+const minEvictInterval = time.Second
+
 // The cache service caches the consul service registration information
 // to prevent consul from being overly pressured by each request to consul.
 type cache struct {
@@ -37,11 +49,31 @@ type cache struct {
 
 	// Observe whether watched has been called, and modify the value when called.
 	watched map[string]bool
-	watcher *consulWatcher
-	// The current cached consul data version.
-	version uint64
+	// Subscriptions of the node changes of each service.
+	subscriptions map[string]map[*Subscription]bool
+	// Sync state of each service with consul.
+	freshness map[string]*Freshness
+	// The unix nano time of the last lookup of each watched service.
+	lastAccess map[string]*int64
+	// The failures of looking up the services not cached, they are served until expired or the nodes are cached.
+	negative map[string]*negativeEntry
+	// Closed when the first query of the watched service is done, either cached or failed.
+	initialSync map[string]chan struct{}
+	watcher     *consulWatcher
+	// Network coordinates of the consul nodes, nil if near is not set.
+	coordinates *coordinates
+	// Whether the cache has changed since the snapshot was saved.
+	dirty bool
 	// Exit.
 	exit chan bool
+	// Running background goroutines.
+	wg sync.WaitGroup
+}
+
+// negativeEntry is the cached failure of looking up a service.
+type negativeEntry struct {
+	err       error
+	expiresAt time.Time
 }
 
 // setLocked function sets up the service nodes, must guarded by write lock and then operate.
@@ -50,6 +82,12 @@ func (c *cache) setLocked(serviceName string, nodes *serviceNodes) {
 		return
 	}
 	c.nodesCache[serviceName] = nodes
+	c.dirty = true
+	delete(c.negative, serviceName)
+	c.initialSyncedLocked(serviceName)
+	for s := range c.subscriptions[serviceName] {
+		s.notify(nodes)
+	}
 }
 
 // cache service nodes.
@@ -69,13 +107,22 @@ func (c *cache) cache(serviceName string, version uint64, nodes *serviceNodes) e
 	if _, ok := c.watched[serviceName]; !ok {
 		return nil
 	}
-	if version > c.version {
-		c.version = version
+	if c.outdatedLocked(serviceName, version) {
+		log.Debugf("Discovery::cache drop outdated nodes of service:%s at index %d", serviceName, version)
+		return nil
 	}
+	nodes.index = version
 	c.setLocked(serviceName, nodes)
 	return nil
 }
 
+// outdatedLocked reports whether the nodes at the consul index are older than the cached ones,
+// must guarded by lock.
+func (c *cache) outdatedLocked(serviceName string, index uint64) bool {
+	cached, ok := c.nodesCache[serviceName]
+	return ok && !cached.seed && index < cached.index
+}
+
 // update updates the cache according to consul changes.
 func (c *cache) update(result *watchResult) {
 	if result == nil || result.healthyEntries == nil {
@@ -90,15 +137,13 @@ func (c *cache) update(result *watchResult) {
 	if _, ok := c.watched[serviceName]; !ok {
 		return
 	}
-	_, ok := c.nodesCache[serviceName]
-	if !ok {
-		// Incremental quantity updates only start after getting more than full data.
+	if !result.reset && c.outdatedLocked(serviceName, result.Version) {
+		log.Debugf("Discovery::update drop outdated nodes of service:%s at index %d", serviceName, result.Version)
 		return
 	}
-	nodes := &serviceNodes{
-		HealthyNodes:   convertNodes(result.healthyEntries),
-		UnhealthyNodes: convertNodes(result.unhealthyEntries),
-	}
+	nodes := newServiceNodes(serviceName, result.healthyEntries, result.unhealthyEntries, c.opts.addressTag)
+	c.fillRTT(nodes)
+	nodes.index = result.Version
 	c.setLocked(serviceName, nodes)
 }
 
@@ -106,89 +151,402 @@ func (c *cache) update(result *watchResult) {
 func (c *cache) List(serviceName string) (*serviceNodes, error) {
 	// Obtain from cache first.
 	c.RLock()
+	if c.closedLocked() {
+		c.RUnlock()
+		return nil, consul_error.DiscoveryClosedError
+	}
+	if accessed, ok := c.lastAccess[serviceName]; ok {
+		atomic.StoreInt64(accessed, time.Now().UnixNano())
+	}
 	nodes, isExisting := c.nodesCache[serviceName]
-	if isExisting {
+	if isExisting && nodes.seed && time.Since(nodes.syncedAt) > c.opts.snapshotMaxAge {
+		// The seed loaded from the snapshot is too old to serve.
+		nodes, isExisting = nil, false
+	}
+	_, ok := c.watched[serviceName]
+	if isExisting && c.tooStaleLocked(serviceName) {
+		c.RUnlock()
+		return nil, consul_error.StaleNodesError
+	}
+	if isExisting && ok {
 		c.RUnlock()
 		return nodes, nil
 	}
+	if negative, found := c.negative[serviceName]; ok && found && time.Now().Before(negative.expiresAt) {
+		c.RUnlock()
+		return nil, negative.err
+	}
 
 	// Set up services that need attention.
-	_, ok := c.watched[serviceName]
 	c.RUnlock()
 	if !ok {
 		c.Lock()
-		c.watched[serviceName] = true
-		c.watcher.watchService(serviceName)
+		if c.closedLocked() {
+			c.Unlock()
+			return nil, consul_error.DiscoveryClosedError
+		}
+		c.watchLocked(serviceName)
 		c.Unlock()
 	}
-	return nil, nil
+	return nodes, nil
+}
+
+// fail caches the failure of looking up the watched service for the negative ttl,
+// so that the lookups do not go to consul again until it expires or the watcher gets the nodes.
+// The failures of the context of the caller are not cached, as they say nothing about consul.
+func (c *cache) fail(serviceName string, err error) {
+	if err == nil || contextError(err) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.watched[serviceName]; !ok {
+		return
+	}
+	if _, ok := c.nodesCache[serviceName]; ok {
+		return
+	}
+	c.negative[serviceName] = &negativeEntry{err: err, expiresAt: time.Now().Add(c.opts.negativeTTL)}
+}
+
+// contextError reports whether the error is caused by the context of the query being canceled or timing out.
+func contextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// watchLocked starts watching the service if it is not watched, must guarded by write lock.
+func (c *cache) watchLocked(serviceName string) {
+	if _, ok := c.watched[serviceName]; ok {
+		return
+	}
+	c.watched[serviceName] = true
+	accessed := time.Now().UnixNano()
+	c.lastAccess[serviceName] = &accessed
+	if _, ok := c.nodesCache[serviceName]; !ok {
+		c.initialSync[serviceName] = make(chan struct{})
+	}
+	c.watcher.watchService(serviceName)
+}
+
+// initialSyncedLocked wakes up the lookups waiting for the first query of the service, must guarded by write lock.
+func (c *cache) initialSyncedLocked(serviceName string) {
+	if ch, ok := c.initialSync[serviceName]; ok {
+		close(ch)
+		delete(c.initialSync, serviceName)
+	}
+}
+
+// waitInitialSync waits for at most timeout until the first query of the service by the watcher is done,
+// and returns the cached nodes then, which are nil if the query failed or timed out.
+func (c *cache) waitInitialSync(ctx context.Context, serviceName string, timeout time.Duration) (*serviceNodes, error) {
+	c.RLock()
+	ch, ok := c.initialSync[serviceName]
+	c.RUnlock()
+	if ok {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-ch:
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return c.List(serviceName)
+}
+
+// subscribe subscribes the node changes of the service, the current nodes are sent at once if they are cached.
+func (c *cache) subscribe(serviceName string) (*Subscription, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closedLocked() {
+		return nil, consul_error.DiscoveryClosedError
+	}
+	c.watchLocked(serviceName)
+	s := newSubscription(serviceName, c.unsubscribe)
+	if c.subscriptions[serviceName] == nil {
+		c.subscriptions[serviceName] = make(map[*Subscription]bool)
+	}
+	c.subscriptions[serviceName][s] = true
+	if nodes, ok := c.nodesCache[serviceName]; ok {
+		s.notify(nodes)
+	}
+	return s, nil
+}
+
+// unsubscribe removes the subscription and closes its event channel.
+func (c *cache) unsubscribe(s *Subscription) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.subscriptions[s.serviceName], s)
+	if len(c.subscriptions[s.serviceName]) == 0 {
+		delete(c.subscriptions, s.serviceName)
+	}
+	s.close()
+}
+
+// evictIdle stops watching the services which have not been looked up for the idle ttl and evicts their cache.
+func (c *cache) evictIdle(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for serviceName, accessed := range c.lastAccess {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(accessed))) <= c.opts.idleTTL {
+			continue
+		}
+		if len(c.subscriptions[serviceName]) > 0 {
+			// Services subscribed are never idle.
+			continue
+		}
+		log.Debugf("Discovery::evictIdle service:%s is idle for more than %s, stop watching it",
+			serviceName, c.opts.idleTTL)
+		c.watcher.unwatchService(serviceName)
+		delete(c.watched, serviceName)
+		delete(c.nodesCache, serviceName)
+		delete(c.freshness, serviceName)
+		delete(c.lastAccess, serviceName)
+		delete(c.negative, serviceName)
+		c.initialSyncedLocked(serviceName)
+	}
+}
+
+// evict evicts idle services periodically until the cache is stopped.
+func (c *cache) evict() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(evictInterval(c.opts.idleTTL))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.exit:
+				return
+			case now := <-ticker.C:
+				c.evictIdle(now)
+			}
+		}
+	}()
+}
+
+// evictInterval returns the interval of evicting the services idle for the ttl, which is half of the ttl
+// and no less than minEvictInterval.
+func evictInterval(idleTTL time.Duration) time.Duration {
+	if interval := idleTTL / 2; interval > minEvictInterval {
+		return interval
+	}
+	return minEvictInterval
 }
 
 // watch for modifying the cache follows consul changes.
 func (c *cache) watch() {
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		watchResults := c.watcher.watch()
-		for result := range watchResults {
+		for {
 			select {
 			case <-c.exit:
 				return
-			default:
+			case result := <-watchResults:
 				c.update(result)
 			}
 		}
 	}()
 }
 
+// closedLocked reports whether the cache is stopped, must guarded by lock.
+func (c *cache) closedLocked() bool {
+	select {
+	case <-c.exit:
+		return true
+	default:
+		return false
+	}
+}
+
 // stop stops the cache and stops the consul watch at the same time.
 func (c *cache) stop() {
 	c.Lock()
 	defer c.Unlock()
 
-	select {
-	case <-c.exit:
+	if c.closedLocked() {
 		return
-	default:
-		close(c.exit)
 	}
+	close(c.exit)
 	c.watcher.stop()
+	for serviceName := range c.initialSync {
+		c.initialSyncedLocked(serviceName)
+	}
+	for _, subscriptions := range c.subscriptions {
+		for s := range subscriptions {
+			s.close()
+		}
+	}
+}
+
+// wait waits for the background goroutines of the stopped cache and its watcher to exit,
+// the pending consul changes are drained meanwhile.
+func (c *cache) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		c.watcher.wg.Wait()
+		close(done)
+	}()
+	watchResults := c.watcher.watch()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-watchResults:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
-// convertNodes converts consul node to trpc node.
-func convertNodes(entries []*api.ServiceEntry) []*tregistry.Node {
+// convertNodes converts consul node to trpc node, nodes without a usable address are dropped.
+func convertNodes(entries []*api.ServiceEntry, addressTag string) []*tregistry.Node {
 	nodes := make([]*tregistry.Node, 0, len(entries))
 	for _, s := range entries {
-		meta := make(map[string]interface{})
+		host, port := serviceAddress(s, addressTag)
+		if host == "" {
+			log.Warnf("Discovery::convertNodes drop service:%s id:%s, which has no usable address",
+				s.Service.Service, s.Service.ID)
+			continue
+		}
+		meta := make(map[string]interface{}, len(s.Service.Meta)+11)
 		for k, v := range s.Service.Meta {
 			meta[k] = v
 		}
+		fillMetadata(meta, s)
 		node := &tregistry.Node{
-			ServiceName: s.Service.ID,
-			Address:     net.JoinHostPort(s.Service.Address, strconv.Itoa(s.Service.Port)),
+			ServiceName: s.Service.Service,
+			Address:     net.JoinHostPort(host, strconv.Itoa(port)),
 			Metadata:    meta,
-			Weight:      s.Service.Weights.Passing,
+			Weight:      serviceWeight(s),
 		}
 		nodes = append(nodes, node)
 	}
 	return nodes
 }
 
+// serviceWeight returns the weight of the service by the aggregated status of its checks,
+// the warning weight is used if it is warning.
+func serviceWeight(s *api.ServiceEntry) int {
+	if s.Checks.AggregatedStatus() == api.HealthWarning {
+		return s.Service.Weights.Warning
+	}
+	return s.Service.Weights.Passing
+}
+
+// newServiceNodes converts consul entries to service nodes of the service name, which may carry query parameters.
+func newServiceNodes(name string, healthyEntries, unhealthyEntries []*api.ServiceEntry,
+	addressTag string) *serviceNodes {
+	nodes := &serviceNodes{
+		HealthyNodes:     convertNodes(healthyEntries, addressTag),
+		UnhealthyNodes:   convertNodes(unhealthyEntries, addressTag),
+		healthyEntries:   healthyEntries,
+		unhealthyEntries: unhealthyEntries,
+		syncedAt:         time.Now(),
+	}
+	callee := serviceName(name)
+	for _, n := range [][]*tregistry.Node{nodes.HealthyNodes, nodes.UnhealthyNodes} {
+		for _, node := range n {
+			node.Metadata[MetaCallee] = callee
+		}
+	}
+	return nodes
+}
+
+// fillRTT fills the estimated rtt into the metadata of the nodes if near is set.
+func (c *cache) fillRTT(nodes *serviceNodes) {
+	if c.coordinates != nil {
+		c.coordinates.fill(nodes)
+	}
+}
+
+// serviceAddress returns the address of the service entry. A service registered without an address
+// inherits the address of its node, the tagged address is preferred if it is configured.
+func serviceAddress(s *api.ServiceEntry, addressTag string) (string, int) {
+	if s.Service.Address != "" {
+		return s.Service.Address, s.Service.Port
+	}
+	if addressTag != "" {
+		if addr, ok := s.Service.TaggedAddresses[addressTag]; ok && addr.Address != "" {
+			if addr.Port != 0 {
+				return addr.Address, addr.Port
+			}
+			return addr.Address, s.Service.Port
+		}
+		if s.Node != nil && s.Node.TaggedAddresses[addressTag] != "" {
+			return s.Node.TaggedAddresses[addressTag], s.Service.Port
+		}
+	}
+	if s.Node != nil {
+		return s.Node.Address, s.Service.Port
+	}
+	return "", 0
+}
+
+// fillMetadata fills the consul information of the service entry into the node metadata.
+func fillMetadata(meta map[string]interface{}, s *api.ServiceEntry) {
+	meta[MetaServiceID] = s.Service.ID
+	meta[MetaTags] = s.Service.Tags
+	meta[MetaHealth] = s.Checks.AggregatedStatus()
+	meta[MetaWeightPassing] = s.Service.Weights.Passing
+	meta[MetaWeightWarning] = s.Service.Weights.Warning
+	datacenter := s.Service.Datacenter
+	if s.Node != nil {
+		meta[MetaNode] = s.Node.Node
+		meta[MetaNodeID] = s.Node.ID
+		meta[MetaNodeMeta] = s.Node.Meta
+		if s.Node.Datacenter != "" {
+			datacenter = s.Node.Datacenter
+		}
+	}
+	meta[MetaDatacenter] = datacenter
+}
+
 // newCache creates a new cache.
 func newCache(options ...Option) (*cache, error) {
 	watcher, err := newConsulWatcher(options...)
 	if err != nil {
 		return nil, err
 	}
-	opts := &Options{}
+	opts := &Options{
+		snapshotInterval: defaultSnapshotInterval,
+		snapshotMaxAge:   defaultSnapshotMaxAge,
+		negativeTTL:      defaultNegativeTTL,
+	}
 	for _, o := range options {
 		o(opts)
 	}
 	c := &cache{
-		opts:       opts,
-		watched:    make(map[string]bool),
-		nodesCache: make(map[string]*serviceNodes),
-		exit:       make(chan bool),
-		watcher:    watcher,
+		opts:          opts,
+		watched:       make(map[string]bool),
+		freshness:     make(map[string]*Freshness),
+		lastAccess:    make(map[string]*int64),
+		initialSync:   make(map[string]chan struct{}),
+		negative:      make(map[string]*negativeEntry),
+		subscriptions: make(map[string]map[*Subscription]bool),
+		nodesCache:    make(map[string]*serviceNodes),
+		exit:          make(chan bool),
+		watcher:       watcher,
+	}
+	watcher.syncHandler = c.synced
+	if opts.snapshotDir != "" {
+		if err := c.loadSnapshot(); err != nil {
+			log.Warnf("Discovery::newCache failed to load snapshot from %s, err: %s", c.snapshotPath(), err)
+		}
+		c.snapshot()
+	}
+	if opts.near != "" {
+		c.coordinates = newCoordinates(opts)
+		c.refreshCoordinates()
 	}
 	c.watch()
+	if opts.idleTTL > 0 {
+		c.evict()
+	}
 	return c, nil
 }
@@ -14,7 +14,14 @@
 package discovery
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/glycerine/goconvey/convey"
 	"github.com/golang/mock/gomock"
@@ -43,7 +50,7 @@ func Test_cache_List(t *testing.T) {
 		tmp.Service.Port = 1000
 		tmp.Service.Weights.Passing = 10
 
-		c, err := newCache(WithClient(client))
+		c, err := newTestCache(WithClient(client))
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		// Obtain it once first, which means paying attention to this service, and subsequent updates of this service will take effect.
@@ -87,7 +94,7 @@ func Test_cache_stop(t *testing.T) {
 	Convey("关闭缓存", t, func() {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		c, err := newCache(WithClient(client))
+		c, err := newTestCache(WithClient(client))
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		c.stop()
@@ -104,18 +111,54 @@ func Test_convertNodes(t *testing.T) {
 		tmp.Service.Address = "8.8.8.8"
 		tmp.Service.Port = 1000
 		tmp.Service.Weights.Passing = 10
-		nodes := convertNodes([]*api.ServiceEntry{tmp})
+		nodes := convertNodes([]*api.ServiceEntry{tmp}, "")
 		So(len(nodes), ShouldEqual, 1)
-		nodes = convertNodes([]*api.ServiceEntry{})
+		nodes = convertNodes([]*api.ServiceEntry{}, "")
 		So(len(nodes), ShouldEqual, 0)
 	})
+	Convey("节点转换携带consul信息", t, func() {
+		tmp := &api.ServiceEntry{
+			Node: &api.Node{
+				ID:         "node-id",
+				Node:       "node-1",
+				Address:    "9.9.9.9",
+				Datacenter: "dc1",
+				Meta:       map[string]string{"rack": "r1"},
+			},
+			Service: &api.AgentService{
+				ID:      "test-8.8.8.8-1000",
+				Service: "test",
+				Tags:    []string{"v1", "canary"},
+				Meta:    map[string]string{"key": "value"},
+				Address: "8.8.8.8",
+				Port:    1000,
+				Weights: api.AgentWeights{Passing: 10, Warning: 1},
+			},
+			Checks: api.HealthChecks{&api.HealthCheck{Status: api.HealthWarning}},
+		}
+		nodes := convertNodes([]*api.ServiceEntry{tmp}, "")
+		So(len(nodes), ShouldEqual, 1)
+		node := nodes[0]
+		So(node.ServiceName, ShouldEqual, "test")
+		So(node.Address, ShouldEqual, "8.8.8.8:1000")
+		So(node.Metadata["key"], ShouldEqual, "value")
+		So(node.Metadata[MetaServiceID], ShouldEqual, "test-8.8.8.8-1000")
+		So(node.Metadata[MetaTags], ShouldResemble, []string{"v1", "canary"})
+		So(node.Metadata[MetaNode], ShouldEqual, "node-1")
+		So(node.Metadata[MetaNodeID], ShouldEqual, "node-id")
+		So(node.Metadata[MetaDatacenter], ShouldEqual, "dc1")
+		So(node.Metadata[MetaNodeMeta], ShouldResemble, map[string]string{"rack": "r1"})
+		So(node.Metadata[MetaHealth], ShouldEqual, api.HealthWarning)
+		So(node.Metadata[MetaWeightPassing], ShouldEqual, 10)
+		So(node.Metadata[MetaWeightWarning], ShouldEqual, 1)
+	})
 }
 
 func Test_cache_watch(t *testing.T) {
 	Convey("watch", t, func() {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		c, err := newCache(WithClient(client))
+		c, err := newTestCache(WithClient(client))
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		c.watch()
@@ -134,7 +177,7 @@ func Test_cache_cache(t *testing.T) {
 		tmp.Service.Port = 1000
 		tmp.Service.Weights.Passing = 10
 
-		c, err := newCache(WithClient(client))
+		c, err := newTestCache(WithClient(client))
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		// Empty cache.
@@ -142,8 +185,8 @@ func Test_cache_cache(t *testing.T) {
 		So(err, ShouldBeNil)
 		// The cache has not been obtained and does not take effect.
 		_ = c.cache("test", 2, &serviceNodes{
-			HealthyNodes:   convertNodes([]*api.ServiceEntry{tmp}),
-			UnhealthyNodes: convertNodes([]*api.ServiceEntry{tmp}),
+			HealthyNodes:   convertNodes([]*api.ServiceEntry{tmp}, ""),
+			UnhealthyNodes: convertNodes([]*api.ServiceEntry{tmp}, ""),
 		})
 		nodes, err := c.List("test")
 		So(nodes, ShouldBeNil)
@@ -153,11 +196,272 @@ func Test_cache_cache(t *testing.T) {
 		_, _ = c.List("test")
 		// Cache an empty cache first.
 		err = c.cache("test", 2, &serviceNodes{
-			HealthyNodes:   convertNodes([]*api.ServiceEntry{tmp}),
-			UnhealthyNodes: convertNodes([]*api.ServiceEntry{tmp}),
+			HealthyNodes:   convertNodes([]*api.ServiceEntry{tmp}, ""),
+			UnhealthyNodes: convertNodes([]*api.ServiceEntry{tmp}, ""),
 		})
 		So(err, ShouldBeNil)
 		nodes, _ = c.List("test")
 		So(len(nodes.HealthyNodes), ShouldEqual, 1)
 	})
 }
+
+func Test_serviceAddress(t *testing.T) {
+	Convey("服务地址为空时使用节点地址", t, func() {
+		tmp := &api.ServiceEntry{
+			Node: &api.Node{
+				Node:            "node-1",
+				Address:         "9.9.9.9",
+				TaggedAddresses: map[string]string{"wan": "1.1.1.1"},
+			},
+			Service: &api.AgentService{
+				ID:      "1",
+				Service: "test",
+				Port:    1000,
+				TaggedAddresses: map[string]api.ServiceAddress{
+					"lan": {Address: "10.0.0.1", Port: 2000},
+				},
+			},
+		}
+		nodes := convertNodes([]*api.ServiceEntry{tmp}, "")
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Address, ShouldEqual, "9.9.9.9:1000")
+		nodes = convertNodes([]*api.ServiceEntry{tmp}, "lan")
+		So(nodes[0].Address, ShouldEqual, "10.0.0.1:2000")
+		nodes = convertNodes([]*api.ServiceEntry{tmp}, "wan")
+		So(nodes[0].Address, ShouldEqual, "1.1.1.1:1000")
+		nodes = convertNodes([]*api.ServiceEntry{tmp}, "not_exist")
+		So(nodes[0].Address, ShouldEqual, "9.9.9.9:1000")
+
+		tmp.Service.Address = "8.8.8.8"
+		nodes = convertNodes([]*api.ServiceEntry{tmp}, "lan")
+		So(nodes[0].Address, ShouldEqual, "8.8.8.8:1000")
+	})
+	Convey("没有可用地址的节点被丢弃", t, func() {
+		tmp := &api.ServiceEntry{Service: &api.AgentService{ID: "1", Service: "test", Port: 1000}}
+		nodes := convertNodes([]*api.ServiceEntry{tmp}, "lan")
+		So(len(nodes), ShouldEqual, 0)
+		tmp.Node = &api.Node{Node: "node-1"}
+		nodes = convertNodes([]*api.ServiceEntry{tmp}, "")
+		So(len(nodes), ShouldEqual, 0)
+	})
+}
+
+func Test_cache_evictIdle(t *testing.T) {
+	Convey("淘汰空闲服务", t, func() {
+		c, err := newTestCache(WithClient(client), WithIdleTTL(time.Minute))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		// state returns whether the service is watched, cached and has a watcher.
+		state := func(serviceName string) (bool, bool, bool) {
+			c.RLock()
+			defer c.RUnlock()
+			return c.watched[serviceName], c.nodesCache[serviceName] != nil,
+				c.watcher.serviceWatcher[serviceName] != nil
+		}
+		_, _ = c.List("idle")
+		_, _ = c.List("busy")
+		So(c.cache("idle", 1, &serviceNodes{}), ShouldBeNil)
+		So(c.cache("busy", 1, &serviceNodes{}), ShouldBeNil)
+
+		c.evictIdle(time.Now())
+		watched, cached, _ := state("idle")
+		So(watched, ShouldBeTrue)
+		So(cached, ShouldBeTrue)
+
+		c.RLock()
+		atomic.StoreInt64(c.lastAccess["idle"], time.Now().Add(-2*time.Minute).UnixNano())
+		c.RUnlock()
+		c.evictIdle(time.Now())
+		watched, cached, hasWatcher := state("idle")
+		So(watched, ShouldBeFalse)
+		So(cached, ShouldBeFalse)
+		So(hasWatcher, ShouldBeFalse)
+		watched, cached, _ = state("busy")
+		So(watched, ShouldBeTrue)
+		So(cached, ShouldBeTrue)
+
+		// Watched again on the next lookup.
+		nodes, err := c.List("idle")
+		So(err, ShouldBeNil)
+		So(nodes, ShouldBeNil)
+		watched, _, hasWatcher = state("idle")
+		So(watched, ShouldBeTrue)
+		So(hasWatcher, ShouldBeTrue)
+	})
+	Convey("极小的空闲时间", t, func() {
+		So(evictInterval(time.Minute), ShouldEqual, 30*time.Second)
+		So(evictInterval(time.Nanosecond), ShouldEqual, minEvictInterval)
+		c, err := newTestCache(WithClient(client), WithIdleTTL(time.Nanosecond))
+		So(err, ShouldBeNil)
+		stopAndWait(c)
+	})
+}
+
+// newTestCache creates a cache whose watcher never receives changes from consul,
+// so that the cache is only changed by the test.
+func newTestCache(options ...Option) (*cache, error) {
+	c, err := newCache(options...)
+	if err != nil {
+		return nil, err
+	}
+	c.watcher.fetchFunc = func(*serviceWatcher) fetchFunc {
+		return func(ctx context.Context, index uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			<-ctx.Done()
+			return nil, nil, ctx.Err()
+		}
+	}
+	return c, nil
+}
+
+func Test_cache_outOfOrder(t *testing.T) {
+	entry := func(id string) *api.ServiceEntry {
+		return &api.ServiceEntry{Service: &api.AgentService{ID: id, Address: "8.8.8.8", Port: 1000}}
+	}
+	healthyID := func(c *cache, serviceName string) string {
+		nodes, err := c.List(serviceName)
+		So(err, ShouldBeNil)
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+		return nodes.HealthyNodes[0].Metadata[MetaServiceID].(string)
+	}
+	// watch watches the service and caches it empty, so that the watch results are applied.
+	watch := func(c *cache, serviceName string) {
+		_, _ = c.List(serviceName)
+		So(c.cache(serviceName, 0, &serviceNodes{}), ShouldBeNil)
+	}
+	Convey("过期的直接查询结果不覆盖较新的watch结果", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		watch(c, "test")
+		c.update(&watchResult{serviceName: "test", Version: 10, healthyEntries: []*api.ServiceEntry{entry("watch")}})
+		So(c.cache("test", 5, newServiceNodes("test", []*api.ServiceEntry{entry("query")}, nil, "")), ShouldBeNil)
+		So(healthyID(c, "test"), ShouldEqual, "watch")
+		So(c.cache("test", 10, newServiceNodes("test", []*api.ServiceEntry{entry("query")}, nil, "")), ShouldBeNil)
+		So(healthyID(c, "test"), ShouldEqual, "query")
+	})
+	Convey("过期的watch结果不覆盖较新的直接查询结果", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		watch(c, "test")
+		So(c.cache("test", 10, newServiceNodes("test", []*api.ServiceEntry{entry("query")}, nil, "")), ShouldBeNil)
+		c.update(&watchResult{serviceName: "test", Version: 5, healthyEntries: []*api.ServiceEntry{entry("watch")}})
+		So(healthyID(c, "test"), ShouldEqual, "query")
+		c.update(&watchResult{serviceName: "test", Version: 11, healthyEntries: []*api.ServiceEntry{entry("watch")}})
+		So(healthyID(c, "test"), ShouldEqual, "watch")
+	})
+	Convey("索引回退时watch结果替换缓存", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		watch(c, "test")
+		So(c.cache("test", 10, newServiceNodes("test", []*api.ServiceEntry{entry("old")}, nil, "")), ShouldBeNil)
+		c.update(&watchResult{serviceName: "test", Version: 3, healthyEntries: []*api.ServiceEntry{entry("new")},
+			reset: true})
+		So(healthyID(c, "test"), ShouldEqual, "new")
+		// Later results are compared with the index after the reset.
+		So(c.cache("test", 4, newServiceNodes("test", []*api.ServiceEntry{entry("query")}, nil, "")), ShouldBeNil)
+		So(healthyID(c, "test"), ShouldEqual, "query")
+	})
+	Convey("各服务的索引互不影响", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		watch(c, "a")
+		watch(c, "b")
+		c.update(&watchResult{serviceName: "a", Version: 100, healthyEntries: []*api.ServiceEntry{entry("a")}})
+		c.update(&watchResult{serviceName: "b", Version: 1, healthyEntries: []*api.ServiceEntry{entry("b")}})
+		So(healthyID(c, "b"), ShouldEqual, "b")
+	})
+	Convey("并发写入后保留最大索引的结果", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		watch(c, "test")
+		const n = 50
+		var wg sync.WaitGroup
+		for i := 1; i <= n; i++ {
+			wg.Add(2)
+			id := strconv.Itoa(i)
+			go func(index uint64) {
+				defer wg.Done()
+				_ = c.cache("test", index, newServiceNodes("test", []*api.ServiceEntry{entry(id)}, nil, ""))
+			}(uint64(i))
+			go func(index uint64) {
+				defer wg.Done()
+				c.update(&watchResult{serviceName: "test", Version: index, healthyEntries: []*api.ServiceEntry{entry(id)}})
+			}(uint64(i))
+		}
+		wg.Wait()
+		So(healthyID(c, "test"), ShouldEqual, strconv.Itoa(n))
+	})
+}
+
+func Test_cache_update_beforeCached(t *testing.T) {
+	Convey("服务缓存前的watch结果不被丢弃", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		_, _ = c.List("test")
+		c.update(&watchResult{serviceName: "test", Version: 3,
+			healthyEntries: []*api.ServiceEntry{newTestEntry("1", 1000, 10)}})
+		nodes, err := c.waitInitialSync(context.Background(), "test", time.Minute)
+		So(err, ShouldBeNil)
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+		// The direct query result at an older index does not overwrite it.
+		So(c.cache("test", 2, &serviceNodes{}), ShouldBeNil)
+		nodes, _ = c.List("test")
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+	})
+}
+
+func Test_cache_fail(t *testing.T) {
+	Convey("缓存寻址失败", t, func() {
+		c, err := newTestCache(WithClient(client), WithNegativeTTL(time.Minute))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		queryErr := errors.New("connection refused")
+		// Services not watched are not cached.
+		c.fail("test", queryErr)
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(nodes, ShouldBeNil)
+
+		c.fail("test", queryErr)
+		_, err = c.List("test")
+		So(err, ShouldEqual, queryErr)
+
+		// Dropped as soon as the watcher gets the nodes.
+		c.update(&watchResult{serviceName: "test", Version: 1,
+			healthyEntries: []*api.ServiceEntry{newTestEntry("1", 1000, 10)}})
+		nodes, err = c.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+		// Failures of services cached are ignored.
+		c.fail("test", queryErr)
+		_, err = c.List("test")
+		So(err, ShouldBeNil)
+	})
+	Convey("不缓存调用方ctx导致的失败", t, func() {
+		c, err := newTestCache(WithClient(client), WithNegativeTTL(time.Minute))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		_, _ = c.List("test")
+		c.fail("test", context.Canceled)
+		c.fail("test", fmt.Errorf("query: %w", context.DeadlineExceeded))
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(nodes, ShouldBeNil)
+	})
+	Convey("寻址失败缓存过期", t, func() {
+		c, err := newTestCache(WithClient(client), WithNegativeTTL(time.Millisecond))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		_, _ = c.List("test")
+		c.fail("test", errors.New("connection refused"))
+		time.Sleep(5 * time.Millisecond)
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(nodes, ShouldBeNil)
+	})
+}
@@ -0,0 +1,192 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"trpc.group/trpc-go/trpc-go/log"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+const (
+	// NearAgent is the near parameter of consul which means the node of the consul agent queried.
+	NearAgent = "_agent"
+
+	// coordinateInterval is the interval of refreshing the network coordinates.
+	coordinateInterval = 30 * time.Second
+)
+
+// coordinates are the network coordinates of the consul nodes, which estimate the rtt from the near node.
+type coordinates struct {
+	opts *Options
+
+	mu sync.RWMutex
+	// The coordinate of the near node and the coordinates of all nodes in the same network segment by name.
+	origin *api.CoordinateEntry
+	nodes  map[string]*api.CoordinateEntry
+}
+
+// newCoordinates creates the network coordinates.
+func newCoordinates(opts *Options) *coordinates {
+	return &coordinates{
+		opts:  opts,
+		nodes: make(map[string]*api.CoordinateEntry),
+	}
+}
+
+// refresh fetches the network coordinates of all nodes from consul.
+func (c *coordinates) refresh() error {
+	near := c.opts.near
+	if near == NearAgent {
+		name, err := c.opts.client.Agent().NodeName()
+		if err != nil {
+			return err
+		}
+		near = name
+	}
+	entries, _, err := c.opts.client.Coordinate().Nodes(nil)
+	if err != nil {
+		return err
+	}
+	var origin *api.CoordinateEntry
+	for _, e := range entries {
+		// The coordinate in the default segment is preferred if the node is in several segments.
+		if e.Node == near && e.Coord != nil && (origin == nil || e.Segment == "") {
+			origin = e
+		}
+	}
+	if origin == nil {
+		return fmt.Errorf("coordinate of node %s not found", near)
+	}
+	nodes := make(map[string]*api.CoordinateEntry, len(entries))
+	for _, e := range entries {
+		if e.Segment == origin.Segment && e.Coord != nil && e.Coord.IsCompatibleWith(origin.Coord) {
+			nodes[e.Node] = e
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.origin = origin
+	c.nodes = nodes
+	return nil
+}
+
+// rtt returns the estimated rtt from the near node to the node, false if it is unknown.
+func (c *coordinates) rtt(node string) (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.origin == nil {
+		return 0, false
+	}
+	e, ok := c.nodes[node]
+	if !ok {
+		return 0, false
+	}
+	return c.origin.Coord.DistanceTo(e.Coord), true
+}
+
+// fill fills the estimated rtt into the metadata of the nodes whose coordinates are known.
+func (c *coordinates) fill(nodes *serviceNodes) {
+	for _, list := range [][]*tregistry.Node{nodes.HealthyNodes, nodes.UnhealthyNodes} {
+		for _, node := range list {
+			name, _ := node.Metadata[MetaNode].(string)
+			if rtt, ok := c.rtt(name); ok {
+				node.Metadata[MetaRTT] = rtt
+			}
+		}
+	}
+}
+
+// refill returns the nodes with the rtt estimated by the current coordinates, the nodes whose rtt changes are
+// copied instead of modified as they may be in use, and false is returned if none of them changes.
+func (c *coordinates) refill(nodes []*tregistry.Node) ([]*tregistry.Node, bool) {
+	var refilled []*tregistry.Node
+	for i, node := range nodes {
+		name, _ := node.Metadata[MetaNode].(string)
+		rtt, ok := c.rtt(name)
+		last, filled := node.Metadata[MetaRTT].(time.Duration)
+		if ok == filled && rtt == last {
+			continue
+		}
+		if refilled == nil {
+			refilled = append(make([]*tregistry.Node, 0, len(nodes)), nodes...)
+		}
+		n := *node
+		n.Metadata = make(map[string]interface{}, len(node.Metadata)+1)
+		for k, v := range node.Metadata {
+			n.Metadata[k] = v
+		}
+		if ok {
+			n.Metadata[MetaRTT] = rtt
+		} else {
+			delete(n.Metadata, MetaRTT)
+		}
+		refilled[i] = &n
+	}
+	if refilled == nil {
+		return nodes, false
+	}
+	return refilled, true
+}
+
+// refillRTT refills the estimated rtt of the cached nodes after the coordinates are refreshed, so that the nodes
+// cached before the first refresh get their rtt and the rtt of stable services does not go stale.
+func (c *cache) refillRTT() {
+	c.Lock()
+	defer c.Unlock()
+	for serviceName, nodes := range c.nodesCache {
+		if nodes == nil {
+			continue
+		}
+		healthy, healthyChanged := c.coordinates.refill(nodes.HealthyNodes)
+		unhealthy, unhealthyChanged := c.coordinates.refill(nodes.UnhealthyNodes)
+		if !healthyChanged && !unhealthyChanged {
+			continue
+		}
+		refilled := *nodes
+		refilled.HealthyNodes, refilled.UnhealthyNodes = healthy, unhealthy
+		c.nodesCache[serviceName] = &refilled
+		for s := range c.subscriptions[serviceName] {
+			s.notify(&refilled)
+		}
+	}
+}
+
+// refreshCoordinates refreshes the network coordinates periodically until the cache is stopped.
+func (c *cache) refreshCoordinates() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(coordinateInterval)
+		defer ticker.Stop()
+		for {
+			if err := c.coordinates.refresh(); err != nil {
+				log.Warnf("Discovery::refreshCoordinates failed to refresh coordinates near %s, err: %s",
+					c.opts.near, err)
+			} else {
+				c.refillRTT()
+			}
+			select {
+			case <-c.exit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
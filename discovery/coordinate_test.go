@@ -0,0 +1,155 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+)
+
+// newTestCoordinate returns the coordinate entry of the node which is x seconds away from the origin.
+func newTestCoordinate(node, segment string, x float64) *api.CoordinateEntry {
+	e := &api.CoordinateEntry{}
+	data := []byte(`{"Node":"` + node + `","Segment":"` + segment + `","Coord":{"Vec":[` +
+		strconv.FormatFloat(x, 'f', -1, 64) + `,0,0,0,0,0,0,0],"Error":1.5,"Adjustment":0,"Height":0}}`)
+	if err := json.Unmarshal(data, e); err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func Test_coordinates(t *testing.T) {
+	Convey("根据网络坐标估计RTT", t, func() {
+		patches := ApplyMethod(reflect.TypeOf(client.Agent()), "NodeName", func(*api.Agent) (string, error) {
+			return "local", nil
+		}).ApplyMethod(reflect.TypeOf(client.Coordinate()), "Nodes", func(*api.Coordinate,
+			*api.QueryOptions) ([]*api.CoordinateEntry, *api.QueryMeta, error) {
+			return []*api.CoordinateEntry{
+				newTestCoordinate("local", "", 0),
+				newTestCoordinate("local", "seg", 1),
+				newTestCoordinate("near", "", 0.01),
+				newTestCoordinate("far", "", 0.1),
+				newTestCoordinate("other", "seg", 0.01),
+			}, &api.QueryMeta{}, nil
+		})
+		defer patches.Reset()
+
+		c := newCoordinates(&Options{client: client, near: NearAgent})
+		_, ok := c.rtt("near")
+		So(ok, ShouldBeFalse)
+		So(c.refresh(), ShouldBeNil)
+		rtt, ok := c.rtt("near")
+		So(ok, ShouldBeTrue)
+		So(rtt, ShouldEqual, 10*time.Millisecond)
+		rtt, _ = c.rtt("far")
+		So(rtt, ShouldEqual, 100*time.Millisecond)
+		// Nodes in other segments are unknown.
+		_, ok = c.rtt("other")
+		So(ok, ShouldBeFalse)
+
+		near := newTestEntry("1", 1000, 10)
+		near.Node = &api.Node{Node: "near"}
+		unknown := newTestEntry("2", 1000, 10)
+		unknown.Node = &api.Node{Node: "unknown"}
+		nodes := newServiceNodes("test", []*api.ServiceEntry{near, unknown}, nil, "")
+		c.fill(nodes)
+		So(nodes.HealthyNodes[0].Metadata[MetaRTT], ShouldEqual, 10*time.Millisecond)
+		_, ok = nodes.HealthyNodes[1].Metadata[MetaRTT]
+		So(ok, ShouldBeFalse)
+
+		c = newCoordinates(&Options{client: client, near: "not_exist"})
+		So(c.refresh(), ShouldNotBeNil)
+	})
+	Convey("坐标刷新后重新填充缓存节点的RTT", t, func() {
+		x := 0.01
+		patches := ApplyMethod(reflect.TypeOf(client.Coordinate()), "Nodes", func(*api.Coordinate,
+			*api.QueryOptions) ([]*api.CoordinateEntry, *api.QueryMeta, error) {
+			return []*api.CoordinateEntry{newTestCoordinate("local", "", 0), newTestCoordinate("near", "", x)},
+				&api.QueryMeta{}, nil
+		})
+		defer patches.Reset()
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		c.coordinates = newCoordinates(&Options{client: client, near: "local"})
+
+		// The nodes are cached before the first refresh.
+		_, _ = c.List("test")
+		entry := newTestEntry("1", 1000, 10)
+		entry.Node = &api.Node{Node: "near"}
+		So(c.cache("test", 1, newServiceNodes("test", []*api.ServiceEntry{entry}, nil, "")), ShouldBeNil)
+		cached, err := c.List("test")
+		So(err, ShouldBeNil)
+		_, ok := cached.HealthyNodes[0].Metadata[MetaRTT]
+		So(ok, ShouldBeFalse)
+
+		So(c.coordinates.refresh(), ShouldBeNil)
+		c.refillRTT()
+		refilled, _ := c.List("test")
+		So(refilled.HealthyNodes[0].Metadata[MetaRTT], ShouldEqual, 10*time.Millisecond)
+		// The nodes in use are not modified.
+		_, ok = cached.HealthyNodes[0].Metadata[MetaRTT]
+		So(ok, ShouldBeFalse)
+
+		x = 0.02
+		So(c.coordinates.refresh(), ShouldBeNil)
+		c.refillRTT()
+		nodes, _ := c.List("test")
+		So(nodes.HealthyNodes[0].Metadata[MetaRTT], ShouldEqual, 20*time.Millisecond)
+		So(refilled.HealthyNodes[0].Metadata[MetaRTT], ShouldEqual, 10*time.Millisecond)
+		// Unchanged nodes are not replaced.
+		c.refillRTT()
+		unchanged, _ := c.List("test")
+		So(unchanged, ShouldEqual, nodes)
+	})
+	Convey("坐标刷新不产生节点变更事件", t, func() {
+		x := 0.01
+		patches := ApplyMethod(reflect.TypeOf(client.Coordinate()), "Nodes", func(*api.Coordinate,
+			*api.QueryOptions) ([]*api.CoordinateEntry, *api.QueryMeta, error) {
+			return []*api.CoordinateEntry{newTestCoordinate("local", "", 0), newTestCoordinate("near", "", x)},
+				&api.QueryMeta{}, nil
+		})
+		defer patches.Reset()
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		c.coordinates = newCoordinates(&Options{client: client, near: "local"})
+		_, _ = c.List("test")
+		entry := newTestEntry("1", 1000, 10)
+		entry.Node = &api.Node{Node: "near"}
+		So(c.cache("test", 1, newServiceNodes("test", []*api.ServiceEntry{entry}, nil, "")), ShouldBeNil)
+		s, err := c.subscribe("test")
+		So(err, ShouldBeNil)
+		So(receive(s), ShouldNotBeNil)
+
+		for _, x = range []float64{0.01, 0.02} {
+			So(c.coordinates.refresh(), ShouldBeNil)
+			c.refillRTT()
+			So(receive(s), ShouldBeNil)
+		}
+		nodes, _ := c.List("test")
+		So(nodes.HealthyNodes[0].Metadata[MetaRTT], ShouldEqual, 20*time.Millisecond)
+	})
+	Convey("near参数传给consul", t, func() {
+		q := (&Options{near: NearAgent}).queryOptions()
+		So(q.Near, ShouldEqual, NearAgent)
+	})
+}
@@ -0,0 +1,97 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Freshness is the sync state of the nodes of a service with consul.
+type Freshness struct {
+	// LastSync is the time of the last successful query to consul.
+	LastSync time.Time
+	// LastError is the error of the last failed query to consul, and LastErrorTime is the time of it.
+	LastError     error
+	LastErrorTime time.Time
+	// LastContact and KnownLeader are the query meta of the last successful query, LastContact is how long
+	// the consul server answering it had not contacted the leader, and KnownLeader is whether it knew the leader.
+	LastContact time.Duration
+	KnownLeader bool
+}
+
+// Failing reports whether the last query to consul failed, the nodes may be out of date then.
+func (f Freshness) Failing() bool {
+	return f.LastError != nil && f.LastErrorTime.After(f.LastSync)
+}
+
+// Staleness returns how long the nodes have been out of sync with consul, it is 0 if the last query succeeded.
+func (f Freshness) Staleness(now time.Time) time.Duration {
+	if !f.Failing() {
+		return 0
+	}
+	return now.Sub(f.LastSync)
+}
+
+// synced records the result of a query to consul for the service.
+func (c *cache) synced(serviceName string, meta *api.QueryMeta, err error) {
+	if contextError(err) {
+		// The query is canceled as the watcher stops, or the direct query runs out of the time of the caller.
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.watched[serviceName]; !ok {
+		return
+	}
+	f, ok := c.freshness[serviceName]
+	if !ok {
+		f = &Freshness{}
+		c.freshness[serviceName] = f
+	}
+	now := time.Now()
+	if err != nil {
+		f.LastError = err
+		f.LastErrorTime = now
+		c.initialSyncedLocked(serviceName)
+		return
+	}
+	f.LastSync = now
+	if meta != nil {
+		f.LastContact = meta.LastContact
+		f.KnownLeader = meta.KnownLeader
+	}
+}
+
+// Freshness returns the sync state of the nodes of the service, false if the service is unknown.
+func (c *cache) Freshness(serviceName string) (Freshness, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	f, ok := c.freshness[serviceName]
+	if !ok {
+		return Freshness{}, false
+	}
+	return *f, true
+}
+
+// tooStaleLocked reports whether the nodes of the service are staler than the max staleness,
+// must guarded by lock.
+func (c *cache) tooStaleLocked(serviceName string) bool {
+	if c.opts.maxStaleness <= 0 {
+		return false
+	}
+	f, ok := c.freshness[serviceName]
+	return ok && f.Staleness(time.Now()) > c.opts.maxStaleness
+}
@@ -0,0 +1,106 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
+)
+
+func TestFreshness_Staleness(t *testing.T) {
+	Convey("节点过期时间", t, func() {
+		now := time.Now()
+		f := Freshness{LastSync: now.Add(-time.Minute)}
+		So(f.Failing(), ShouldBeFalse)
+		So(f.Staleness(now), ShouldEqual, 0)
+
+		f.LastError = errors.New("connection refused")
+		f.LastErrorTime = now
+		So(f.Failing(), ShouldBeTrue)
+		So(f.Staleness(now), ShouldEqual, time.Minute)
+
+		f.LastSync = now.Add(time.Second)
+		So(f.Failing(), ShouldBeFalse)
+		So(f.Staleness(now), ShouldEqual, 0)
+	})
+}
+
+func Test_cache_synced(t *testing.T) {
+	Convey("记录同步状态", t, func() {
+		c, err := newTestCache(WithClient(client), WithMaxStaleness(time.Minute))
+		So(err, ShouldBeNil)
+		defer c.stop()
+
+		// Services not watched are ignored.
+		c.synced("test", nil, nil)
+		_, ok := c.Freshness("test")
+		So(ok, ShouldBeFalse)
+
+		_, _ = c.List("test")
+		So(c.cache("test", 1, newTestNodes(newTestEntry("1", 1000, 10))), ShouldBeNil)
+		c.synced("test", &api.QueryMeta{LastContact: time.Second, KnownLeader: true}, nil)
+		f, ok := c.Freshness("test")
+		So(ok, ShouldBeTrue)
+		So(f.LastSync.IsZero(), ShouldBeFalse)
+		So(f.Failing(), ShouldBeFalse)
+		So(f.LastContact, ShouldEqual, time.Second)
+		So(f.KnownLeader, ShouldBeTrue)
+
+		// The canceled query of a stopped watcher and the timeout of the caller are ignored.
+		c.synced("test", nil, context.Canceled)
+		c.synced("test", nil, fmt.Errorf("query: %w", context.DeadlineExceeded))
+		f, _ = c.Freshness("test")
+		So(f.LastError, ShouldBeNil)
+
+		// The last known nodes are served within the max staleness.
+		c.synced("test", nil, errors.New("connection refused"))
+		f, _ = c.Freshness("test")
+		So(f.Failing(), ShouldBeTrue)
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+
+		c.Lock()
+		c.freshness["test"].LastSync = time.Now().Add(-2 * time.Minute)
+		c.Unlock()
+		_, err = c.List("test")
+		So(err, ShouldEqual, consul_error.StaleNodesError)
+
+		c.synced("test", nil, nil)
+		nodes, err = c.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+	})
+}
+
+func TestDiscovery_Freshness(t *testing.T) {
+	Convey("获取同步状态", t, func() {
+		d, err := New(WithClient(client))
+		So(err, ShouldBeNil)
+		_, ok := d.Freshness("test")
+		So(ok, ShouldBeFalse)
+		_, err = d.List("test")
+		So(err, ShouldBeNil)
+		f, ok := d.Freshness("test")
+		So(ok, ShouldBeTrue)
+		So(f.LastSync.IsZero(), ShouldBeFalse)
+	})
+}
@@ -14,6 +14,11 @@
 package discovery
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/hashicorp/consul/api"
 	"golang.org/x/sync/singleflight"
 	"trpc.group/trpc-go/trpc-go/log"
@@ -22,6 +27,9 @@ import (
 	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
 )
 
+// defaultInitialSyncTimeout is how long the first lookup of a service waits for its watcher by default.
+const defaultInitialSyncTimeout = time.Second
+
 // DefaultDiscovery instantiated objects by Discovery structure.
 var DefaultDiscovery *Discovery
 
@@ -35,16 +43,31 @@ type Discovery struct {
 type serviceNodes struct {
 	HealthyNodes   []*registry.Node
 	UnhealthyNodes []*registry.Node
+
+	// Consul entries which the nodes are converted from, they are saved in the snapshot.
+	healthyEntries   []*api.ServiceEntry
+	unhealthyEntries []*api.ServiceEntry
+	// The consul index of the nodes.
+	index uint64
+	// The time the nodes were fetched from consul.
+	syncedAt time.Time
+	// Whether the nodes are loaded from the snapshot, they are served until the first live result arrives.
+	seed bool
 }
 
 // New instantiates discovery.
 func New(options ...Option) (*Discovery, error) {
 	d := &Discovery{
-		opts: &Options{},
+		opts: &Options{
+			initialSyncTimeout: defaultInitialSyncTimeout,
+		},
 	}
 	for _, o := range options {
 		o(d.opts)
 	}
+	if err := d.opts.checkConsistency(); err != nil {
+		return nil, err
+	}
 	var err error
 	d.cache, err = newCache(options...)
 	if err != nil {
@@ -53,57 +76,77 @@ func New(options ...Option) (*Discovery, error) {
 	return d, nil
 }
 
-// List gets available service nodes, including only the healthy ones.
+// List gets available service nodes, including only the healthy ones, which are passing or warning.
 func (d *Discovery) List(serviceName string, opts ...tdiscovery.Option) ([]*registry.Node, error) {
-	nodes, _, err := d.ListAll(serviceName, opts...)
+	nodes, unhealthyNodes, err := d.ListAll(serviceName, opts...)
 	if err != nil {
 		return nil, err
 	}
 	if len(nodes) == 0 {
-		return nil, consul_error.ServerNotAvailableError
+		return nil, notAvailableError(unhealthyNodes)
 	}
 	return nodes, nil
 }
 
-// ListAll gets all service nodes, including healthy and unhealthy ones.
+// notAvailableError returns the error of a service without healthy nodes, ServiceNotFoundError if it has no nodes
+// at all, which means the service does not exist or is not deployed.
+func notAvailableError(unhealthyNodes []*registry.Node) error {
+	if len(unhealthyNodes) == 0 {
+		return consul_error.ServiceNotFoundError
+	}
+	return consul_error.ServerNotAvailableError
+}
+
+// ListAll gets all service nodes, including healthy and unhealthy ones. The service name may carry query
+// parameters such as service?tag=v2&dc=sh, see ParseTarget, each distinct name is watched separately.
 func (d *Discovery) ListAll(serviceName string, opts ...tdiscovery.Option) (healthyNodes []*registry.Node,
 	unhealthyNodes []*registry.Node, err error) {
+	if _, err = ParseTarget(serviceName); err != nil {
+		return nil, nil, err
+	}
 	var nodes *serviceNodes
 	nodes, err = d.cache.List(serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
 	if nodes != nil {
-		return nodes.HealthyNodes, nodes.UnhealthyNodes, err
+		return nodes.HealthyNodes, nodes.UnhealthyNodes, nil
 	}
 
-	// The cache is not found, go to consul to get it
-	val, err, _ := d.sg.Do(serviceName, func() (interface{}, error) {
-		nodes, err = d.cache.List(serviceName)
-		if err != nil || healthyNodes != nil {
-			return &serviceNodes{HealthyNodes: healthyNodes, UnhealthyNodes: unhealthyNodes}, err
-		}
+	o := &tdiscovery.Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ctx := o.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// The first lookup waits for the first result of the watcher, so that the watcher and the cache
+	// start from the same index, and consul is queried directly only if the watcher is late.
+	nodes, err = d.cache.waitInitialSync(ctx, serviceName, d.opts.initialSyncTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nodes != nil {
+		return nodes.HealthyNodes, nodes.UnhealthyNodes, nil
+	}
 
-		o := &tdiscovery.Options{}
-		for _, opt := range opts {
-			opt(o)
+	// The watcher is late or failed, go to consul to get it, the result is reconciled with the watcher by index.
+	val, err, _ := d.sg.Do(serviceName, func() (interface{}, error) {
+		nodes, err := d.cache.List(serviceName)
+		if err != nil || nodes != nil {
+			return nodes, err
 		}
-		queryOpts := &api.QueryOptions{}
-		queryOpts = queryOpts.WithContext(o.Ctx)
-		serviceEntries, queryMeta, err := d.opts.client.Health().Service(serviceName, "", true, queryOpts)
+		serviceEntries, queryMeta, index, err := d.query(ctx, serviceName)
+		d.cache.synced(serviceName, queryMeta, err)
 		if err != nil {
+			d.cache.fail(serviceName, err)
 			return nil, err
 		}
-		var healthEntries, unhealthEntries []*api.ServiceEntry
-		for _, service := range serviceEntries {
-			if service.Checks.AggregatedStatus() == api.HealthPassing {
-				healthEntries = append(healthEntries, service)
-			} else {
-				unhealthEntries = append(unhealthEntries, service)
-			}
-		}
-		nodes := &serviceNodes{
-			HealthyNodes:   convertNodes(healthEntries),
-			UnhealthyNodes: convertNodes(unhealthEntries),
-		}
-		_ = d.cache.cache(serviceName, queryMeta.LastIndex, nodes)
+		healthEntries, unhealthEntries := splitEntries(serviceEntries)
+		nodes = newServiceNodes(serviceName, healthEntries, unhealthEntries, d.opts.addressTag)
+		d.cache.fillRTT(nodes)
+		_ = d.cache.cache(serviceName, index, nodes)
 		return nodes, nil
 	})
 	if err != nil {
@@ -116,3 +159,66 @@ func (d *Discovery) ListAll(serviceName string, opts ...tdiscovery.Option) (heal
 	}
 	return nil, nil, nil
 }
+
+// query queries the service from consul directly, and returns the index of the results to compare with
+// the results of the watcher.
+func (d *Discovery) query(ctx context.Context, serviceName string) ([]*api.ServiceEntry, *api.QueryMeta,
+	uint64, error) {
+	if name, ok := preparedQueryName(serviceName); ok {
+		// The index of the watcher of prepared queries is made up, the results never overwrite those of the watcher.
+		entries, meta, err := executePreparedQuery(ctx, d.opts.serviceOptions(serviceName), name)
+		return entries, meta, 0, err
+	}
+	opts := d.opts.serviceOptions(serviceName)
+	entries, meta, err := healthService(ctx, opts, serviceName, opts.queryOptions())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return entries, meta, meta.LastIndex, nil
+}
+
+// Preload looks up the services concurrently, so that their nodes are cached and their watchers are started
+// before the first call. It waits until ctx is done at most, and returns the error of the first service failed,
+// including those without healthy nodes.
+func (d *Discovery) Preload(ctx context.Context, serviceNames ...string) error {
+	errs := make([]error, len(serviceNames))
+	var wg sync.WaitGroup
+	for i, serviceName := range serviceNames {
+		wg.Add(1)
+		go func(i int, serviceName string) {
+			defer wg.Done()
+			nodes, unhealthyNodes, err := d.ListAll(serviceName, tdiscovery.WithContext(ctx))
+			if err == nil && len(nodes) == 0 {
+				err = notAvailableError(unhealthyNodes)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("preload service %s: %w", serviceName, err)
+			}
+		}(i, serviceName)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch subscribes the node changes of the service, the current nodes are sent at once if they are known.
+// Call Unsubscribe of the returned subscription to stop receiving events.
+func (d *Discovery) Watch(serviceName string) (*Subscription, error) {
+	return d.cache.subscribe(serviceName)
+}
+
+// Freshness returns the sync state of the nodes of the service with consul, false if the service is unknown.
+func (d *Discovery) Freshness(serviceName string) (Freshness, bool) {
+	return d.cache.Freshness(serviceName)
+}
+
+// Close stops watching consul and waits for the background goroutines to exit until ctx is done,
+// List and ListAll return DiscoveryClosedError afterwards.
+func (d *Discovery) Close(ctx context.Context) error {
+	d.cache.stop()
+	return d.cache.wait(ctx)
+}
@@ -14,11 +14,19 @@
 package discovery
 
 import (
+	"context"
+	"errors"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/consul/api"
+	"go.uber.org/goleak"
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
 
 	. "github.com/agiledragon/gomonkey"
 	. "github.com/glycerine/goconvey/convey"
@@ -53,7 +61,7 @@ func getConsulClient() *api.Client {
 		tmp2.Service.Port = 1000
 		tmp2.Service.Weights.Passing = 10
 		tmp2.Checks = append(tmp2.Checks, &api.HealthCheck{
-			Status:    api.HealthWarning,
+			Status:    api.HealthCritical,
 			ServiceID: "2",
 		})
 		return []*api.ServiceEntry{tmp, tmp2}, &api.QueryMeta{LastIndex: 1}, nil
@@ -97,3 +105,287 @@ func TestDiscovery_ListAll(t *testing.T) {
 		So(len(nodes2), ShouldNotEqual, 0)
 	})
 }
+
+func TestDiscovery_Close(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	Convey("关闭服务发现", t, func() {
+		d, err := New(WithClient(client), WithIdleTTL(time.Minute))
+		So(err, ShouldBeNil)
+		for _, serviceName := range []string{"test", "test1", "test2"} {
+			nodes, err := d.List(serviceName)
+			So(err, ShouldBeNil)
+			So(len(nodes), ShouldNotEqual, 0)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		So(d.Close(ctx), ShouldBeNil)
+		So(d.Close(ctx), ShouldBeNil)
+
+		_, err = d.List("test")
+		So(err, ShouldEqual, consul_error.DiscoveryClosedError)
+		_, _, err = d.ListAll("test3")
+		So(err, ShouldEqual, consul_error.DiscoveryClosedError)
+	})
+}
+
+// newFirstFetch returns a fetch which returns the entries at the index or the error at the first query,
+// and blocks afterwards.
+func newFirstFetch(entries []*api.ServiceEntry, index uint64, err error) func(*serviceWatcher) fetchFunc {
+	return func(*serviceWatcher) fetchFunc {
+		var fetched int32
+		return func(ctx context.Context, _ uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			if atomic.AddInt32(&fetched, 1) > 1 {
+				<-ctx.Done()
+				return nil, nil, ctx.Err()
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			return entries, &api.QueryMeta{LastIndex: index}, nil
+		}
+	}
+}
+
+func TestDiscovery_ListAll_initialSync(t *testing.T) {
+	Convey("首次寻址等待watch的首次结果", t, func() {
+		d, err := New(WithClient(client), WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = newFirstFetch([]*api.ServiceEntry{newTestEntry("watch", 2000, 10)}, 5, nil)
+		nodes, _, err := d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Metadata[MetaServiceID], ShouldEqual, "watch")
+	})
+	Convey("watch首次查询失败时直接查询consul", t, func() {
+		d, err := New(WithClient(client), WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = newFirstFetch(nil, 0, errors.New("connection refused"))
+		start := time.Now()
+		nodes, _, err := d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Metadata[MetaServiceID], ShouldEqual, "1")
+		So(time.Since(start), ShouldBeLessThan, time.Minute)
+	})
+	Convey("watch超时未返回时直接查询consul, 之后的watch结果按index更新缓存", t, func() {
+		d, err := New(WithClient(client), WithInitialSyncTimeout(10*time.Millisecond))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = func(*serviceWatcher) fetchFunc {
+			return func(ctx context.Context, _ uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+				<-ctx.Done()
+				return nil, nil, ctx.Err()
+			}
+		}
+		nodes, _, err := d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Metadata[MetaServiceID], ShouldEqual, "1")
+
+		// The late result of the watcher at an older index is dropped, and the newer one is applied.
+		d.cache.update(&watchResult{serviceName: "test", Version: 0,
+			healthyEntries: []*api.ServiceEntry{newTestEntry("old", 2000, 10)}})
+		nodes, _, err = d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(nodes[0].Metadata[MetaServiceID], ShouldEqual, "1")
+		d.cache.update(&watchResult{serviceName: "test", Version: 2,
+			healthyEntries: []*api.ServiceEntry{newTestEntry("new", 2000, 10)}})
+		nodes, _, err = d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(nodes[0].Metadata[MetaServiceID], ShouldEqual, "new")
+	})
+	Convey("等待不超过调用方ctx的超时", t, func() {
+		d, err := New(WithClient(client), WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = func(*serviceWatcher) fetchFunc {
+			return func(ctx context.Context, _ uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+				<-ctx.Done()
+				return nil, nil, ctx.Err()
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err = d.ListAll("test", tdiscovery.WithContext(ctx))
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+	})
+	Convey("直接查询超过调用方ctx的超时不影响之后的寻址", t, func() {
+		patches := ApplyMethod(reflect.TypeOf(client.Health()), "Service", func(h *api.Health, service, tag string,
+			passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			if _, ok := q.Context().Deadline(); ok {
+				<-q.Context().Done()
+				return nil, nil, q.Context().Err()
+			}
+			return []*api.ServiceEntry{newTestEntry("1", 1000, 10)}, &api.QueryMeta{LastIndex: 1}, nil
+		})
+		defer patches.Reset()
+		d, err := New(WithClient(client), WithInitialSyncTimeout(time.Millisecond))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = func(*serviceWatcher) fetchFunc {
+			return func(ctx context.Context, _ uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+				<-ctx.Done()
+				return nil, nil, ctx.Err()
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err = d.ListAll("test", tdiscovery.WithContext(ctx))
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		f, _ := d.Freshness("test")
+		So(f.LastError, ShouldBeNil)
+
+		nodes, _, err := d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+	})
+}
+
+func TestDiscovery_Preload(t *testing.T) {
+	Convey("预先寻址服务", t, func() {
+		d, err := New(WithClient(client))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		So(d.Preload(context.Background(), "test", "test1"), ShouldBeNil)
+		for _, serviceName := range []string{"test", "test1"} {
+			nodes, err := d.cache.List(serviceName)
+			So(err, ShouldBeNil)
+			So(len(nodes.HealthyNodes), ShouldNotEqual, 0)
+		}
+	})
+	Convey("预先寻址的服务没有健康节点", t, func() {
+		d, err := New(WithClient(client))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = newFirstFetch([]*api.ServiceEntry{}, 5, nil)
+		err = d.Preload(context.Background(), "empty")
+		So(errors.Is(err, consul_error.ServiceNotFoundError), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "empty")
+	})
+}
+
+func TestDiscovery_List_notFound(t *testing.T) {
+	Convey("服务没有节点时返回服务不存在", t, func() {
+		d, err := New(WithClient(client), WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = newFirstFetch([]*api.ServiceEntry{}, 5, nil)
+		_, err = d.List("not_exist")
+		So(err, ShouldEqual, consul_error.ServiceNotFoundError)
+
+		// Unavailable if it has unhealthy nodes only.
+		unhealthy := newTestEntry("1", 1000, 10)
+		unhealthy.Checks = api.HealthChecks{&api.HealthCheck{Status: api.HealthCritical}}
+		d.cache.update(&watchResult{serviceName: "not_exist", Version: 6, healthyEntries: emptyServiceEntry,
+			unhealthyEntries: []*api.ServiceEntry{unhealthy}})
+		_, err = d.List("not_exist")
+		So(err, ShouldEqual, consul_error.ServerNotAvailableError)
+	})
+}
+
+func TestDiscovery_ListAll_queryMeta(t *testing.T) {
+	Convey("未知的一致性模式", t, func() {
+		_, err := New(WithClient(client), WithConsistency("unknown"))
+		So(err, ShouldNotBeNil)
+	})
+	Convey("同步状态携带查询的consul server状态", t, func() {
+		d, err := New(WithClient(client), WithConsistency(ConsistencyStale), WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		d.cache.watcher.fetchFunc = func(*serviceWatcher) fetchFunc {
+			var fetched int32
+			return func(ctx context.Context, _ uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+				if atomic.AddInt32(&fetched, 1) > 1 {
+					<-ctx.Done()
+					return nil, nil, ctx.Err()
+				}
+				return []*api.ServiceEntry{newTestEntry("1", 1000, 10)},
+					&api.QueryMeta{LastIndex: 5, LastContact: time.Second, KnownLeader: true}, nil
+			}
+		}
+		nodes, _, err := d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		f, ok := d.Freshness("test")
+		So(ok, ShouldBeTrue)
+		So(f.LastContact, ShouldEqual, time.Second)
+		So(f.KnownLeader, ShouldBeTrue)
+	})
+}
+
+func TestDiscovery_servicesOptions(t *testing.T) {
+	Convey("服务未知的一致性模式", t, func() {
+		_, err := New(WithClient(client), WithServicesOptions(map[string]*ServiceOptions{
+			"test": {Consistency: "unknown"},
+		}))
+		So(err, ShouldNotBeNil)
+	})
+	Convey("服务的配置覆盖全局配置", t, func() {
+		useCache := false
+		d, err := New(WithClient(client), WithConsistency(ConsistencyStale), WithUseCache(true),
+			WithMaxAge(time.Second), WithServicesOptions(map[string]*ServiceOptions{
+				"test": {Consistency: ConsistencyConsistent, UseCache: &useCache, WaitTime: time.Minute},
+			}))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		So(d.opts.serviceOptions("other"), ShouldEqual, d.opts)
+		opts := d.opts.serviceOptions("test")
+		So(opts.consistency, ShouldEqual, ConsistencyConsistent)
+		So(opts.useCache, ShouldBeFalse)
+		So(opts.maxAge, ShouldEqual, time.Second)
+		So(opts.waitTime, ShouldEqual, time.Minute)
+		// The global options are not modified.
+		So(d.opts.consistency, ShouldEqual, ConsistencyStale)
+		So(d.opts.useCache, ShouldBeTrue)
+	})
+}
+
+func TestDiscovery_unhealthyNodes(t *testing.T) {
+	Convey("不健康节点从consul获取并缓存", t, func() {
+		var passingOnly []bool
+		critical := newTestEntry("critical", 1001, 10)
+		critical.Checks = api.HealthChecks{&api.HealthCheck{Status: api.HealthCritical}}
+		entries := []*api.ServiceEntry{newTestEntry("passing", 1000, 10), critical}
+		var mu sync.Mutex
+		patches := ApplyMethod(reflect.TypeOf(client.Health()), "Service", func(h *api.Health, service, tag string,
+			p bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			passingOnly = append(passingOnly, p)
+			return entries, &api.QueryMeta{LastIndex: 1}, nil
+		})
+		defer patches.Reset()
+
+		d, err := New(WithClient(client), WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer func() { _ = d.Close(context.Background()) }()
+
+		// The blocking query of the watcher and the direct query both get the unhealthy nodes.
+		result, _, err := newServiceWatcher("test", d.cache.watcher).health(context.Background(), 0)
+		So(err, ShouldBeNil)
+		So(len(result), ShouldEqual, 2)
+		result, _, _, err = d.query(context.Background(), "test")
+		So(err, ShouldBeNil)
+		So(len(result), ShouldEqual, 2)
+		healthy, unhealthy := splitEntries(result)
+		So(len(healthy), ShouldEqual, 1)
+		So(unhealthy[0].Service.ID, ShouldEqual, "critical")
+
+		nodes, unhealthyNodes, err := d.ListAll("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(len(unhealthyNodes), ShouldEqual, 1)
+		mu.Lock()
+		for _, p := range passingOnly {
+			So(p, ShouldBeFalse)
+		}
+		// A service whose nodes are all critical is unavailable rather than not found.
+		entries = []*api.ServiceEntry{critical}
+		mu.Unlock()
+		_, err = d.List("critical")
+		So(err, ShouldEqual, consul_error.ServerNotAvailableError)
+	})
+}
@@ -0,0 +1,45 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+// Metadata keys filled in by discovery for every node.
+// The service meta registered in consul is copied into the node metadata as is,
+// the keys below are prefixed with "consul_" so that they do not collide with it.
+const (
+	// MetaServiceID is the consul service ID, string.
+	MetaServiceID = "consul_service_id"
+	// MetaTags is the consul service tags, []string.
+	MetaTags = "consul_tags"
+	// MetaNode is the name of the consul node the service is registered on, string.
+	MetaNode = "consul_node"
+	// MetaNodeID is the ID of the consul node the service is registered on, string.
+	MetaNodeID = "consul_node_id"
+	// MetaDatacenter is the datacenter of the consul node, string.
+	MetaDatacenter = "consul_datacenter"
+	// MetaNodeMeta is the metadata of the consul node, map[string]string.
+	MetaNodeMeta = "consul_node_meta"
+	// MetaHealth is the aggregated status of all the checks of the service,
+	// one of api.HealthPassing, api.HealthWarning, api.HealthCritical and api.HealthMaint, string.
+	MetaHealth = "consul_health"
+	// MetaWeightPassing is the weight of the service when it is passing, int.
+	MetaWeightPassing = "consul_weight_passing"
+	// MetaWeightWarning is the weight of the service when it is warning, int.
+	MetaWeightWarning = "consul_weight_warning"
+	// MetaCallee is the service name the node is discovered by, without the query parameters, which is
+	// query/<name> for the prepared query and differs from the service name of the node then, string.
+	MetaCallee = "consul_callee"
+	// MetaRTT is the rtt from the near node to the node estimated by the network coordinates,
+	// it is present only if near is set and the coordinate of the node is known, time.Duration.
+	MetaRTT = "consul_rtt"
+)
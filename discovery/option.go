@@ -13,11 +13,67 @@
 
 package discovery
 
-import "github.com/hashicorp/consul/api"
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Consistency modes of reading from consul.
+const (
+	// ConsistencyDefault reads from the leader, which may be stale shortly in the rare case of leader changes.
+	ConsistencyDefault = "default"
+	// ConsistencyStale reads from any consul server, which spreads the load off the leader.
+	ConsistencyStale = "stale"
+	// ConsistencyConsistent reads from the leader after it confirms its leadership.
+	ConsistencyConsistent = "consistent"
+)
+
+// ServiceOptions the discovery configuration of a service, zero values use the global configuration.
+type ServiceOptions struct {
+	Consistency string        // Consistency mode of reading from consul.
+	MaxAge      time.Duration // Max age of stale results and results cached by the consul agent.
+	UseCache    *bool         // Whether to read the results from the cache of the consul agent.
+	WaitTime    time.Duration // Max time a blocking query waits for changes.
+}
 
 // Options service discovery configuration.
 type Options struct {
-	client *api.Client
+	client     *api.Client
+	addressTag string
+	idleTTL    time.Duration
+	// The max staleness of the nodes served while consul is unreachable.
+	maxStaleness time.Duration
+	// How long the first lookup of a service waits for the first result of its watcher.
+	initialSyncTimeout time.Duration
+	// How long the failure of looking up a service is cached.
+	negativeTTL time.Duration
+
+	// Consistency of reading from consul.
+	consistency string
+	maxAge      time.Duration
+	useCache    bool
+	// The node which the nodes are sorted by the estimated rtt from.
+	near string
+
+	// Blocking queries of the watcher.
+	waitTime             time.Duration
+	maxConcurrentQueries int
+	retryInterval        time.Duration
+	maxRetryInterval     time.Duration
+	minQueryInterval     time.Duration
+	// The interval of polling prepared queries.
+	preparedQueryInterval time.Duration
+
+	snapshotDir      string
+	snapshotInterval time.Duration
+	snapshotMaxAge   time.Duration
+	// The name of the consul cluster, empty for the default one.
+	cluster string
+
+	// The configuration of each service overriding the global one.
+	servicesOptions map[string]*ServiceOptions
 }
 
 // Option configuration function.
@@ -29,3 +85,235 @@ func WithClient(client *api.Client) Option {
 		options.client = client
 	}
 }
+
+// WithAddressTag sets the tagged address, such as "lan" or "wan_ipv4", used when the service
+// is registered without an address. The node address is used if the tagged address does not exist either.
+func WithAddressTag(tag string) Option {
+	return func(options *Options) {
+		options.addressTag = tag
+	}
+}
+
+// WithIdleTTL sets how long a service can stay without lookups before its watcher is stopped
+// and its cache is evicted, it is watched again on the next lookup. Zero means never evict.
+func WithIdleTTL(ttl time.Duration) Option {
+	return func(options *Options) {
+		options.idleTTL = ttl
+	}
+}
+
+// WithCluster sets the name of the consul cluster, which distinguishes the snapshot files of the clusters
+// sharing the snapshot directory. Empty means the default cluster.
+func WithCluster(name string) Option {
+	return func(options *Options) {
+		options.cluster = name
+	}
+}
+
+// WithSnapshotDir sets the directory of the on-disk snapshot of discovered nodes. The snapshot is loaded
+// at startup and served until the first live result arrives. Empty means no snapshot.
+func WithSnapshotDir(dir string) Option {
+	return func(options *Options) {
+		options.snapshotDir = dir
+	}
+}
+
+// WithSnapshotInterval sets the interval of saving the snapshot, 30s by default.
+func WithSnapshotInterval(interval time.Duration) Option {
+	return func(options *Options) {
+		if interval > 0 {
+			options.snapshotInterval = interval
+		}
+	}
+}
+
+// WithSnapshotMaxAge sets the max age of the nodes loaded from the snapshot, 24h by default.
+func WithSnapshotMaxAge(maxAge time.Duration) Option {
+	return func(options *Options) {
+		if maxAge > 0 {
+			options.snapshotMaxAge = maxAge
+		}
+	}
+}
+
+// WithMaxStaleness sets how long the last known nodes are served while queries to consul fail,
+// List returns StaleNodesError afterwards. Zero means serving them forever.
+func WithMaxStaleness(maxStaleness time.Duration) Option {
+	return func(options *Options) {
+		options.maxStaleness = maxStaleness
+	}
+}
+
+// WithInitialSyncTimeout sets how long the first lookup of a service waits for the first result of its watcher,
+// it queries consul directly afterwards, 1s by default. The lookup never waits beyond the deadline of its context.
+func WithInitialSyncTimeout(timeout time.Duration) Option {
+	return func(options *Options) {
+		if timeout > 0 {
+			options.initialSyncTimeout = timeout
+		}
+	}
+}
+
+// WithNegativeTTL sets how long the failure of looking up a service not cached is returned without querying
+// consul again, 5s by default. It is dropped as soon as the watcher gets the nodes of the service.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(options *Options) {
+		if ttl > 0 {
+			options.negativeTTL = ttl
+		}
+	}
+}
+
+// WithConsistency sets the consistency mode of reading from consul, one of ConsistencyDefault, ConsistencyStale
+// and ConsistencyConsistent, ConsistencyDefault by default.
+func WithConsistency(consistency string) Option {
+	return func(options *Options) {
+		options.consistency = consistency
+	}
+}
+
+// WithMaxAge sets the max age of the results read from consul. In the stale mode, results from a server which has
+// not contacted the leader for longer than it are read again from the leader. It is the max age of the results
+// cached by the consul agent as well if the agent cache is used.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(options *Options) {
+		options.maxAge = maxAge
+	}
+}
+
+// WithUseCache sets whether the results are read from the cache of the consul agent, which saves the round trips
+// to consul servers.
+func WithUseCache(useCache bool) Option {
+	return func(options *Options) {
+		options.useCache = useCache
+	}
+}
+
+// WithNear sets the node which the nodes are sorted by the estimated rtt from, NearAgent means the node of
+// the consul agent queried. The estimated rtt of each node is filled into the metadata with the key MetaRTT.
+func WithNear(near string) Option {
+	return func(options *Options) {
+		options.near = near
+	}
+}
+
+// WithWaitTime sets the max time a blocking query of the watcher waits for changes, 5m by default.
+func WithWaitTime(waitTime time.Duration) Option {
+	return func(options *Options) {
+		if waitTime > 0 {
+			options.waitTime = waitTime
+		}
+	}
+}
+
+// WithMaxConcurrentQueries sets the max number of concurrent blocking queries, 256 by default.
+// Services beyond it wait for a free slot, so their changes may be delayed for up to the wait time.
+func WithMaxConcurrentQueries(n int) Option {
+	return func(options *Options) {
+		if n > 0 {
+			options.maxConcurrentQueries = n
+		}
+	}
+}
+
+// WithRetryInterval sets the initial and max interval of retrying failed blocking queries, the interval doubles
+// on each consecutive failure, 1s and 1m by default.
+func WithRetryInterval(interval, maxInterval time.Duration) Option {
+	return func(options *Options) {
+		if interval > 0 {
+			options.retryInterval = interval
+		}
+		if maxInterval > 0 {
+			options.maxRetryInterval = maxInterval
+		}
+	}
+}
+
+// WithPreparedQueryInterval sets the interval of polling the prepared queries, which do not support blocking
+// queries, 10s by default.
+func WithPreparedQueryInterval(interval time.Duration) Option {
+	return func(options *Options) {
+		if interval > 0 {
+			options.preparedQueryInterval = interval
+		}
+	}
+}
+
+// WithMinQueryInterval sets the min interval between two blocking queries of a service, 1s by default.
+func WithMinQueryInterval(interval time.Duration) Option {
+	return func(options *Options) {
+		if interval > 0 {
+			options.minQueryInterval = interval
+		}
+	}
+}
+
+// WithServicesOptions sets the configuration of each service, which overrides the global one.
+func WithServicesOptions(servicesOptions map[string]*ServiceOptions) Option {
+	return func(options *Options) {
+		options.servicesOptions = servicesOptions
+	}
+}
+
+// checkConsistency checks whether the consistency modes of all the services are known.
+func (o *Options) checkConsistency() error {
+	if err := checkConsistency(o.consistency); err != nil {
+		return err
+	}
+	for serviceName, so := range o.servicesOptions {
+		if so == nil {
+			continue
+		}
+		if err := checkConsistency(so.Consistency); err != nil {
+			return fmt.Errorf("service %s: %w", serviceName, err)
+		}
+	}
+	return nil
+}
+
+// checkConsistency checks whether the consistency mode is known.
+func checkConsistency(consistency string) error {
+	switch consistency {
+	case "", ConsistencyDefault, ConsistencyStale, ConsistencyConsistent:
+		return nil
+	default:
+		return fmt.Errorf("unknown consistency mode %s", consistency)
+	}
+}
+
+// serviceOptions returns the options of the service, which are the global ones overridden by its own.
+// The query parameters of the service name are ignored.
+func (o *Options) serviceOptions(name string) *Options {
+	so := o.servicesOptions[serviceName(name)]
+	if so == nil {
+		return o
+	}
+	opts := *o
+	if so.Consistency != "" {
+		opts.consistency = so.Consistency
+	}
+	if so.MaxAge > 0 {
+		opts.maxAge = so.MaxAge
+	}
+	if so.UseCache != nil {
+		opts.useCache = *so.UseCache
+	}
+	if so.WaitTime > 0 {
+		opts.waitTime = so.WaitTime
+	}
+	return &opts
+}
+
+// queryOptions returns the query options of the consistency mode.
+func (o *Options) queryOptions() *api.QueryOptions {
+	q := &api.QueryOptions{
+		AllowStale:        o.consistency == ConsistencyStale,
+		RequireConsistent: o.consistency == ConsistencyConsistent,
+		UseCache:          o.useCache,
+		Near:              o.near,
+	}
+	if o.useCache {
+		q.MaxAge = o.maxAge
+	}
+	return q
+}
@@ -0,0 +1,115 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// PreparedQueryPrefix is the prefix of the service name resolved by the consul prepared query of the name
+	// or ID after it, such as query/helloworld, which fails over to other datacenters as the query defines.
+	PreparedQueryPrefix = "query/"
+
+	defaultPreparedQueryInterval = 10 * time.Second
+)
+
+// preparedQueryName returns the name of the prepared query of the service, false if it is not a prepared query.
+func preparedQueryName(name string) (string, bool) {
+	service := serviceName(name)
+	if !strings.HasPrefix(service, PreparedQueryPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(service, PreparedQueryPrefix), true
+}
+
+// executePreparedQuery executes the prepared query, the datacenter of the results is filled into the nodes.
+func executePreparedQuery(ctx context.Context, opts *Options,
+	name string) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	resp, meta, err := opts.client.PreparedQuery().Execute(name, opts.queryOptions().WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make([]*api.ServiceEntry, 0, len(resp.Nodes))
+	for i := range resp.Nodes {
+		entry := &resp.Nodes[i]
+		if entry.Service == nil {
+			continue
+		}
+		if entry.Service.Datacenter == "" {
+			entry.Service.Datacenter = resp.Datacenter
+		}
+		entries = append(entries, entry)
+	}
+	return entries, meta, nil
+}
+
+// preparedQuery returns the fetch polling the prepared query of the service, as prepared queries do not support
+// blocking queries. The index is made up by the fetch, it increases whenever the results change.
+func (sw *serviceWatcher) preparedQuery(name string) fetchFunc {
+	var (
+		index       uint64
+		fingerprint string
+	)
+	return func(ctx context.Context, lastIndex uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		if lastIndex != 0 && !sleep(ctx, jitter(sw.cw.opts.preparedQueryInterval, waitTimeJitterFraction)) {
+			return nil, nil, ctx.Err()
+		}
+		entries, meta, err := executePreparedQuery(ctx, sw.cw.opts.serviceOptions(sw.serviceName), name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f := entriesFingerprint(entries); index == 0 || f != fingerprint {
+			index++
+			fingerprint = f
+		}
+		result := *meta
+		result.LastIndex = index
+		return entries, &result, nil
+	}
+}
+
+// entriesFingerprint returns the fingerprint of the service entries, which changes when the nodes converted from
+// the entries change.
+func entriesFingerprint(entries []*api.ServiceEntry) string {
+	type entryFingerprint struct {
+		Node       string
+		Datacenter string
+		Service    *api.AgentService
+		Health     string
+	}
+	fingerprints := make([]entryFingerprint, 0, len(entries))
+	for _, e := range entries {
+		f := entryFingerprint{Service: e.Service, Health: e.Checks.AggregatedStatus()}
+		if e.Node != nil {
+			f.Node = e.Node.Node + "/" + e.Node.Address
+			f.Datacenter = e.Node.Datacenter
+		}
+		fingerprints = append(fingerprints, f)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		if fingerprints[i].Node != fingerprints[j].Node {
+			return fingerprints[i].Node < fingerprints[j].Node
+		}
+		return fingerprints[i].Service.ID < fingerprints[j].Service.ID
+	})
+	data, _ := json.Marshal(fingerprints)
+	return string(data)
+}
@@ -0,0 +1,121 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+)
+
+// patchPreparedQuery patches executing prepared queries to return the nodes of the response.
+func patchPreparedQuery(resp func(name string) *api.PreparedQueryExecuteResponse) *Patches {
+	return ApplyMethod(reflect.TypeOf(client.PreparedQuery()), "Execute", func(_ *api.PreparedQuery,
+		name string, _ *api.QueryOptions) (*api.PreparedQueryExecuteResponse, *api.QueryMeta, error) {
+		return resp(name), &api.QueryMeta{LastIndex: 100}, nil
+	})
+}
+
+func Test_preparedQueryName(t *testing.T) {
+	Convey("prepared query服务名", t, func() {
+		name, ok := preparedQueryName("query/helloworld")
+		So(ok, ShouldBeTrue)
+		So(name, ShouldEqual, "helloworld")
+		_, ok = preparedQueryName("helloworld")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func Test_serviceWatcher_preparedQuery(t *testing.T) {
+	Convey("轮询prepared query", t, func() {
+		var (
+			mu    sync.Mutex
+			nodes = []api.ServiceEntry{*newTestEntry("1", 1000, 10)}
+			names []string
+		)
+		patches := patchPreparedQuery(func(name string) *api.PreparedQueryExecuteResponse {
+			mu.Lock()
+			defer mu.Unlock()
+			names = append(names, name)
+			return &api.PreparedQueryExecuteResponse{
+				Nodes:      append([]api.ServiceEntry(nil), nodes...),
+				Datacenter: "dc2",
+				Failovers:  1,
+			}
+		})
+		defer patches.Reset()
+
+		cw, err := newConsulWatcher(WithClient(client), WithPreparedQueryInterval(time.Millisecond))
+		So(err, ShouldBeNil)
+		defer cw.stop()
+		fetch := newServiceWatcher("query/helloworld", cw).fetch
+		entries, meta, err := fetch(context.Background(), 0)
+		So(err, ShouldBeNil)
+		So(meta.LastIndex, ShouldEqual, 1)
+		So(len(entries), ShouldEqual, 1)
+		So(entries[0].Service.Datacenter, ShouldEqual, "dc2")
+		So(names, ShouldResemble, []string{"helloworld"})
+
+		// The index does not change until the nodes change.
+		_, meta, err = fetch(context.Background(), 1)
+		So(err, ShouldBeNil)
+		So(meta.LastIndex, ShouldEqual, 1)
+		mu.Lock()
+		nodes = append(nodes, *newTestEntry("2", 1000, 10))
+		mu.Unlock()
+		entries, meta, err = fetch(context.Background(), 1)
+		So(err, ShouldBeNil)
+		So(meta.LastIndex, ShouldEqual, 2)
+		So(len(entries), ShouldEqual, 2)
+
+		// Polling stops when ctx is done.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err = fetch(ctx, 2)
+		So(err, ShouldEqual, context.Canceled)
+	})
+}
+
+func TestDiscovery_ListAll_preparedQuery(t *testing.T) {
+	Convey("通过prepared query寻址", t, func() {
+		patches := patchPreparedQuery(func(name string) *api.PreparedQueryExecuteResponse {
+			entry := newTestEntry("1", 1000, 10)
+			entry.Node = &api.Node{Node: "node-1", Datacenter: "dc2"}
+			return &api.PreparedQueryExecuteResponse{Nodes: []api.ServiceEntry{*entry}, Datacenter: "dc2"}
+		})
+		defer patches.Reset()
+		d, err := New(WithClient(client))
+		So(err, ShouldBeNil)
+		defer d.cache.stop()
+		nodes, err := d.List("query/helloworld")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Metadata[MetaDatacenter], ShouldEqual, "dc2")
+	})
+}
+
+func Test_entriesFingerprint(t *testing.T) {
+	Convey("节点指纹与顺序无关", t, func() {
+		a, b := newTestEntry("1", 1000, 10), newTestEntry("2", 1000, 10)
+		So(entriesFingerprint([]*api.ServiceEntry{a, b}), ShouldEqual, entriesFingerprint([]*api.ServiceEntry{b, a}))
+		c := newTestEntry("2", 1000, 20)
+		So(entriesFingerprint([]*api.ServiceEntry{a, b}), ShouldNotEqual, entriesFingerprint([]*api.ServiceEntry{a, c}))
+	})
+}
@@ -0,0 +1,173 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"trpc.group/trpc-go/trpc-go/log"
+)
+
+const (
+	// snapshotVersion is the version of the snapshot format, snapshots of other versions are ignored.
+	snapshotVersion = 1
+	// snapshotFile is the file name of the snapshot in the snapshot directory.
+	snapshotFile = "consul_snapshot.json"
+
+	defaultSnapshotInterval = 30 * time.Second
+	defaultSnapshotMaxAge   = 24 * time.Hour
+)
+
+// snapshot is the on-disk snapshot of the cache.
+type snapshot struct {
+	Version  int                         `json:"version"`
+	SavedAt  time.Time                   `json:"saved_at"`
+	Services map[string]*snapshotService `json:"services"`
+}
+
+// snapshotService is the on-disk snapshot of the nodes of a service.
+type snapshotService struct {
+	// SyncedAt is the time the nodes were fetched from consul.
+	SyncedAt  time.Time           `json:"synced_at"`
+	Healthy   []*api.ServiceEntry `json:"healthy"`
+	Unhealthy []*api.ServiceEntry `json:"unhealthy"`
+}
+
+// snapshotPath returns the path of the snapshot file.
+func (c *cache) snapshotPath() string {
+	return filepath.Join(c.opts.snapshotDir, c.snapshotFile())
+}
+
+// snapshotFile returns the file name of the snapshot, which is distinguished by the cluster name,
+// so that clusters can share the snapshot directory.
+func (c *cache) snapshotFile() string {
+	if c.opts.cluster == "" {
+		return snapshotFile
+	}
+	return strings.TrimSuffix(snapshotFile, ".json") + "_" + c.opts.cluster + ".json"
+}
+
+// loadSnapshot loads the snapshot into the cache as stale seeds, which are served until
+// the first live result arrives. Services synced longer than the max age ago are ignored.
+func (c *cache) loadSnapshot() error {
+	data, err := os.ReadFile(c.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s := &snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d is not supported", s.Version)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for serviceName, service := range s.Services {
+		if service == nil || now.Sub(service.SyncedAt) > c.opts.snapshotMaxAge {
+			continue
+		}
+		nodes := newServiceNodes(serviceName, service.Healthy, service.Unhealthy, c.opts.addressTag)
+		nodes.syncedAt = service.SyncedAt
+		nodes.seed = true
+		c.nodesCache[serviceName] = nodes
+		c.freshness[serviceName] = &Freshness{LastSync: service.SyncedAt}
+	}
+	return nil
+}
+
+// saveSnapshot writes the cache into the snapshot file atomically if the cache has changed since last saved.
+func (c *cache) saveSnapshot() error {
+	c.Lock()
+	if !c.dirty {
+		c.Unlock()
+		return nil
+	}
+	c.dirty = false
+	s := &snapshot{
+		Version:  snapshotVersion,
+		SavedAt:  time.Now(),
+		Services: make(map[string]*snapshotService, len(c.nodesCache)),
+	}
+	for serviceName, nodes := range c.nodesCache {
+		if nodes.healthyEntries == nil && nodes.unhealthyEntries == nil {
+			continue
+		}
+		s.Services[serviceName] = &snapshotService{
+			SyncedAt:  nodes.syncedAt,
+			Healthy:   nodes.healthyEntries,
+			Unhealthy: nodes.unhealthyEntries,
+		}
+	}
+	c.Unlock()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.opts.snapshotDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.opts.snapshotDir, c.snapshotFile()+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.snapshotPath())
+}
+
+// snapshot saves the cache periodically until the cache is stopped, and saves it for the last time then.
+func (c *cache) snapshot() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.opts.snapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.exit:
+				if err := c.saveSnapshot(); err != nil {
+					log.Errorf("Discovery::snapshot failed to save snapshot to %s, err: %s", c.snapshotPath(), err)
+				}
+				return
+			case <-ticker.C:
+				if err := c.saveSnapshot(); err != nil {
+					log.Errorf("Discovery::snapshot failed to save snapshot to %s, err: %s", c.snapshotPath(), err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+)
+
+// stopAndWait stops the cache and waits for the snapshot to be saved.
+func stopAndWait(c *cache) {
+	c.stop()
+	_ = c.wait(context.Background())
+}
+
+func Test_cache_snapshot(t *testing.T) {
+	Convey("保存并加载快照", t, func() {
+		dir := t.TempDir()
+		c, err := newTestCache(WithClient(client), WithSnapshotDir(dir))
+		So(err, ShouldBeNil)
+		_, _ = c.List("test")
+		entry := newTestEntry("1", 1000, 10)
+		entry.Service.Tags = []string{"v1"}
+		So(c.cache("test", 1, newServiceNodes("test", []*api.ServiceEntry{entry}, nil, "")), ShouldBeNil)
+		So(c.saveSnapshot(), ShouldBeNil)
+		stopAndWait(c)
+
+		data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+		So(err, ShouldBeNil)
+		s := &snapshot{}
+		So(json.Unmarshal(data, s), ShouldBeNil)
+		So(s.Version, ShouldEqual, snapshotVersion)
+		So(len(s.Services["test"].Healthy), ShouldEqual, 1)
+
+		// Nodes are served from the snapshot before consul responds.
+		c, err = newTestCache(WithClient(client), WithSnapshotDir(dir))
+		So(err, ShouldBeNil)
+		defer stopAndWait(c)
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(nodes, ShouldNotBeNil)
+		So(nodes.seed, ShouldBeTrue)
+		So(len(nodes.HealthyNodes), ShouldEqual, 1)
+		So(nodes.HealthyNodes[0].Address, ShouldEqual, "8.8.8.8:1000")
+		So(nodes.HealthyNodes[0].Metadata[MetaTags], ShouldResemble, []string{"v1"})
+		c.RLock()
+		So(c.watched["test"], ShouldBeTrue)
+		c.RUnlock()
+
+		// The live result replaces the seed.
+		So(c.cache("test", 2, newServiceNodes("test", nil, nil, "")), ShouldBeNil)
+		nodes, err = c.List("test")
+		So(err, ShouldBeNil)
+		So(nodes.seed, ShouldBeFalse)
+		So(len(nodes.HealthyNodes), ShouldEqual, 0)
+	})
+	Convey("忽略过期和不兼容的快照", t, func() {
+		dir := t.TempDir()
+		s := &snapshot{
+			Version: snapshotVersion,
+			SavedAt: time.Now(),
+			Services: map[string]*snapshotService{
+				"old": {
+					SyncedAt: time.Now().Add(-2 * time.Hour),
+					Healthy:  []*api.ServiceEntry{newTestEntry("1", 1000, 10)},
+				},
+				"new": {
+					SyncedAt: time.Now(),
+					Healthy:  []*api.ServiceEntry{newTestEntry("1", 1000, 10)},
+				},
+			},
+		}
+		data, err := json.Marshal(s)
+		So(err, ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, snapshotFile), data, 0644), ShouldBeNil)
+
+		c, err := newTestCache(WithClient(client), WithSnapshotDir(dir), WithSnapshotMaxAge(time.Hour))
+		So(err, ShouldBeNil)
+		nodes, _ := c.List("old")
+		So(nodes, ShouldBeNil)
+		nodes, _ = c.List("new")
+		So(nodes, ShouldNotBeNil)
+		stopAndWait(c)
+
+		s.Version = snapshotVersion + 1
+		data, err = json.Marshal(s)
+		So(err, ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, snapshotFile), data, 0644), ShouldBeNil)
+		c, err = newTestCache(WithClient(client), WithSnapshotDir(dir), WithSnapshotMaxAge(time.Hour))
+		So(err, ShouldBeNil)
+		nodes, _ = c.List("new")
+		So(nodes, ShouldBeNil)
+		stopAndWait(c)
+	})
+}
+
+func Test_cache_snapshotFile(t *testing.T) {
+	Convey("不同集群的快照文件", t, func() {
+		dir := t.TempDir()
+		c, err := newTestCache(WithClient(client), WithSnapshotDir(dir), WithCluster("infra"))
+		So(err, ShouldBeNil)
+		defer stopAndWait(c)
+		So(c.snapshotPath(), ShouldEqual, filepath.Join(dir, "consul_snapshot_infra.json"))
+		_, _ = c.List("test")
+		So(c.cache("test", 1, newServiceNodes("test", []*api.ServiceEntry{newTestEntry("1", 1000, 10)}, nil, "")), ShouldBeNil)
+		So(c.saveSnapshot(), ShouldBeNil)
+		_, err = os.Stat(filepath.Join(dir, "consul_snapshot_infra.json"))
+		So(err, ShouldBeNil)
+		_, err = os.Stat(filepath.Join(dir, snapshotFile))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
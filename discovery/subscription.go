@@ -0,0 +1,187 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"reflect"
+	"sync"
+
+	"trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// Event packages the change of service nodes, it is sent when the healthy nodes change, or the unhealthy nodes
+// are added or removed.
+type Event struct {
+	ServiceName string
+	// Nodes are all the healthy nodes after the change.
+	Nodes []*registry.Node
+	// UnhealthyNodes are all the unhealthy nodes after the change.
+	UnhealthyNodes []*registry.Node
+	// Added, Removed and Changed are the healthy nodes changed since the previous event received.
+	Added   []*registry.Node
+	Removed []*registry.Node
+	Changed []*registry.Node
+}
+
+// Subscription subscribes the node changes of a service.
+// Events are never blocked by a slow subscriber, the event not received yet is merged into the next one,
+// so that the diffs of an event are always relative to the previous event received.
+type Subscription struct {
+	serviceName string
+	events      chan *Event
+	// Healthy and unhealthy nodes of the last event received and the last event sent.
+	received          []*registry.Node
+	receivedUnhealthy []*registry.Node
+	sent              []*registry.Node
+	sentUnhealthy     []*registry.Node
+	closed            bool
+
+	unsubscribe func(*Subscription)
+	once        sync.Once
+}
+
+// newSubscription creates a new subscription.
+func newSubscription(serviceName string, unsubscribe func(*Subscription)) *Subscription {
+	return &Subscription{
+		serviceName: serviceName,
+		events:      make(chan *Event, 1),
+		unsubscribe: unsubscribe,
+	}
+}
+
+// Events returns the channel of node change events, it is closed when unsubscribed or the discovery is closed.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Unsubscribe stops receiving events.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.unsubscribe(s)
+	})
+}
+
+// notify sends the event of the nodes, must guarded by the lock of the cache.
+func (s *Subscription) notify(nodes *serviceNodes) {
+	if s.closed {
+		return
+	}
+	select {
+	case <-s.events:
+		// The last event sent is not received yet, it is replaced by this one.
+	default:
+		s.received, s.receivedUnhealthy = s.sent, s.sentUnhealthy
+	}
+	first := s.received == nil
+	added, removed, changed := diffNodes(s.received, nodes.HealthyNodes)
+	if !first && len(added) == 0 && len(removed) == 0 && len(changed) == 0 &&
+		sameNodes(s.receivedUnhealthy, nodes.UnhealthyNodes) {
+		s.sent, s.sentUnhealthy = s.received, s.receivedUnhealthy
+		return
+	}
+	s.events <- &Event{
+		ServiceName:    s.serviceName,
+		Nodes:          nodes.HealthyNodes,
+		UnhealthyNodes: nodes.UnhealthyNodes,
+		Added:          added,
+		Removed:        removed,
+		Changed:        changed,
+	}
+	s.sent, s.sentUnhealthy = nodes.HealthyNodes, nodes.UnhealthyNodes
+	if s.sent == nil {
+		s.sent = emptyNodes
+	}
+}
+
+// close closes the event channel, must guarded by the lock of the cache.
+func (s *Subscription) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.events)
+}
+
+// diffNodes returns the nodes added, removed and changed from old to new.
+func diffNodes(old, new []*registry.Node) (added, removed, changed []*registry.Node) {
+	oldNodes := make(map[string]*registry.Node, len(old))
+	for _, node := range old {
+		oldNodes[nodeKey(node)] = node
+	}
+	for _, node := range new {
+		key := nodeKey(node)
+		oldNode, ok := oldNodes[key]
+		if !ok {
+			added = append(added, node)
+			continue
+		}
+		delete(oldNodes, key)
+		if oldNode.Address != node.Address || oldNode.Weight != node.Weight ||
+			!sameMetadata(oldNode.Metadata, node.Metadata) {
+			changed = append(changed, node)
+		}
+	}
+	for _, node := range old {
+		if _, ok := oldNodes[nodeKey(node)]; ok {
+			removed = append(removed, node)
+		}
+	}
+	return added, removed, changed
+}
+
+// sameNodes reports whether the nodes are the same ones by the node key.
+func sameNodes(a, b []*registry.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := make(map[string]bool, len(a))
+	for _, node := range a {
+		keys[nodeKey(node)] = true
+	}
+	for _, node := range b {
+		if !keys[nodeKey(node)] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameMetadata reports whether the metadata are the same except the rtt, which drifts with the network coordinates
+// all the time and is not a change of the node.
+func sameMetadata(a, b map[string]interface{}) bool {
+	n := 0
+	for k, v := range a {
+		if k == MetaRTT {
+			continue
+		}
+		if w, ok := b[k]; !ok || !reflect.DeepEqual(v, w) {
+			return false
+		}
+		n++
+	}
+	for k := range b {
+		if k != MetaRTT {
+			n--
+		}
+	}
+	return n == 0
+}
+
+// nodeKey returns the key identifying a node, which is the consul service ID, or the address if it is absent.
+func nodeKey(node *registry.Node) string {
+	if id, ok := node.Metadata[MetaServiceID].(string); ok && id != "" {
+		return id
+	}
+	return node.Address
+}
@@ -0,0 +1,190 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
+)
+
+// newTestEntry creates a service entry for test.
+func newTestEntry(id string, port int, weight int) *api.ServiceEntry {
+	return &api.ServiceEntry{Service: &api.AgentService{
+		ID:      id,
+		Service: "test",
+		Address: "8.8.8.8",
+		Port:    port,
+		Weights: api.AgentWeights{Passing: weight, Warning: weight},
+	}}
+}
+
+// newTestNodes creates service nodes for test.
+func newTestNodes(entries ...*api.ServiceEntry) *serviceNodes {
+	return &serviceNodes{HealthyNodes: convertNodes(entries, ""), UnhealthyNodes: emptyNodes}
+}
+
+// receive receives an event or returns nil if there is none.
+func receive(s *Subscription) *Event {
+	select {
+	case e := <-s.Events():
+		return e
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func Test_cache_subscribe(t *testing.T) {
+	Convey("订阅节点变更", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		_, _ = c.List("test")
+		So(c.cache("test", 1, newTestNodes(newTestEntry("1", 1000, 10), newTestEntry("2", 1001, 10))), ShouldBeNil)
+
+		s, err := c.subscribe("test")
+		So(err, ShouldBeNil)
+		e := receive(s)
+		So(e, ShouldNotBeNil)
+		So(e.ServiceName, ShouldEqual, "test")
+		So(len(e.Nodes), ShouldEqual, 2)
+		So(len(e.Added), ShouldEqual, 2)
+
+		// Unchanged nodes send no event.
+		So(c.cache("test", 2, newTestNodes(newTestEntry("1", 1000, 10), newTestEntry("2", 1001, 10))), ShouldBeNil)
+		So(receive(s), ShouldBeNil)
+
+		So(c.cache("test", 3, newTestNodes(newTestEntry("1", 1000, 20), newTestEntry("3", 1002, 10))), ShouldBeNil)
+		e = receive(s)
+		So(e, ShouldNotBeNil)
+		So(len(e.Nodes), ShouldEqual, 2)
+		So(len(e.Added), ShouldEqual, 1)
+		So(e.Added[0].Address, ShouldEqual, "8.8.8.8:1002")
+		So(len(e.Removed), ShouldEqual, 1)
+		So(e.Removed[0].Address, ShouldEqual, "8.8.8.8:1001")
+		So(len(e.Changed), ShouldEqual, 1)
+		So(e.Changed[0].Weight, ShouldEqual, 20)
+
+		s.Unsubscribe()
+		s.Unsubscribe()
+		_, ok := <-s.Events()
+		So(ok, ShouldBeFalse)
+	})
+	Convey("慢订阅者合并事件", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		s, err := c.subscribe("test")
+		So(err, ShouldBeNil)
+		So(receive(s), ShouldBeNil)
+
+		So(c.cache("test", 1, newTestNodes(newTestEntry("1", 1000, 10))), ShouldBeNil)
+		e := receive(s)
+		So(len(e.Added), ShouldEqual, 1)
+
+		// Neither of the two changes is received, they are merged into one event.
+		So(c.cache("test", 2, newTestNodes(newTestEntry("1", 1000, 10), newTestEntry("2", 1001, 10))), ShouldBeNil)
+		So(c.cache("test", 3, newTestNodes(newTestEntry("2", 1001, 10), newTestEntry("3", 1002, 10))), ShouldBeNil)
+		e = receive(s)
+		So(e, ShouldNotBeNil)
+		So(len(e.Nodes), ShouldEqual, 2)
+		So(len(e.Added), ShouldEqual, 2)
+		So(len(e.Removed), ShouldEqual, 1)
+		So(e.Removed[0].Address, ShouldEqual, "8.8.8.8:1000")
+		So(receive(s), ShouldBeNil)
+
+		// The changes cancel each other out.
+		So(c.cache("test", 4, newTestNodes(newTestEntry("2", 1001, 10))), ShouldBeNil)
+		So(c.cache("test", 5, newTestNodes(newTestEntry("2", 1001, 10), newTestEntry("3", 1002, 10))), ShouldBeNil)
+		So(receive(s), ShouldBeNil)
+	})
+	Convey("不健康节点增减时发送事件", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		_, _ = c.List("test")
+		healthy := []*api.ServiceEntry{newTestEntry("1", 1000, 10)}
+		So(c.cache("test", 1, newServiceNodes("test", healthy, nil, "")), ShouldBeNil)
+		s, err := c.subscribe("test")
+		So(err, ShouldBeNil)
+		So(receive(s), ShouldNotBeNil)
+
+		critical := []*api.ServiceEntry{newTestEntry("2", 1001, 10)}
+		So(c.cache("test", 2, newServiceNodes("test", healthy, critical, "")), ShouldBeNil)
+		e := receive(s)
+		So(e, ShouldNotBeNil)
+		So(len(e.Added)+len(e.Removed)+len(e.Changed), ShouldEqual, 0)
+		So(len(e.UnhealthyNodes), ShouldEqual, 1)
+
+		// Unchanged unhealthy nodes send no event.
+		So(c.cache("test", 3, newServiceNodes("test", healthy, critical, "")), ShouldBeNil)
+		So(receive(s), ShouldBeNil)
+
+		// The unhealthy node is deregistered.
+		So(c.cache("test", 4, newServiceNodes("test", healthy, nil, "")), ShouldBeNil)
+		e = receive(s)
+		So(e, ShouldNotBeNil)
+		So(len(e.UnhealthyNodes), ShouldEqual, 0)
+	})
+	Convey("只有查询的consul server状态变化时节点不变更", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		defer c.stop()
+		_, _ = c.List("test")
+		s, err := c.subscribe("test")
+		So(err, ShouldBeNil)
+		So(receive(s), ShouldBeNil)
+
+		entries := []*api.ServiceEntry{newTestEntry("1", 1000, 10), newTestEntry("2", 1001, 10)}
+		c.update(&watchResult{serviceName: "test", Version: 1, healthyEntries: entries,
+			meta: &api.QueryMeta{LastIndex: 1, LastContact: time.Second, KnownLeader: true}})
+		e := receive(s)
+		So(e, ShouldNotBeNil)
+		So(len(e.Added), ShouldEqual, 2)
+
+		c.update(&watchResult{serviceName: "test", Version: 2, healthyEntries: entries,
+			meta: &api.QueryMeta{LastIndex: 2, LastContact: 2 * time.Second}})
+		So(receive(s), ShouldBeNil)
+	})
+	Convey("关闭缓存后订阅关闭", t, func() {
+		c, err := newTestCache(WithClient(client))
+		So(err, ShouldBeNil)
+		s, err := c.subscribe("test")
+		So(err, ShouldBeNil)
+		c.stop()
+		_, ok := <-s.Events()
+		So(ok, ShouldBeFalse)
+		s.Unsubscribe()
+		_, err = c.subscribe("test")
+		So(err, ShouldEqual, consul_error.DiscoveryClosedError)
+	})
+}
+
+func TestDiscovery_Watch(t *testing.T) {
+	Convey("通过服务发现订阅节点变更", t, func() {
+		d, err := New(WithClient(client))
+		So(err, ShouldBeNil)
+		_, err = d.List("test")
+		So(err, ShouldBeNil)
+		s, err := d.Watch("test")
+		So(err, ShouldBeNil)
+		defer s.Unsubscribe()
+		e := receive(s)
+		So(e, ShouldNotBeNil)
+		So(len(e.Nodes), ShouldNotEqual, 0)
+	})
+}
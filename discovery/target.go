@@ -0,0 +1,152 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Query parameters of the service name, such as consul://service?tag=v2&dc=sh.
+const (
+	// ParamTag keeps the nodes with the tag, it can be repeated to keep the nodes with all the tags.
+	ParamTag = "tag"
+	// ParamDatacenter queries the service in the datacenter instead of the one of the agent.
+	ParamDatacenter = "dc"
+	// ParamNear sorts the nodes by the estimated rtt from the node, _agent means the local agent.
+	ParamNear = "near"
+	// ParamLoadBalancer is the load balancing strategy of the service, which is used by the selector.
+	ParamLoadBalancer = "lb"
+	// ParamPassing is whether consul returns only the nodes passing the health checks, false by default,
+	// so that the unhealthy nodes are cached as well and count in the availability of the service.
+	ParamPassing = "passing"
+	// ParamFilter is the consul filter expression of the nodes.
+	ParamFilter = "filter"
+)
+
+// Target is the service name parsed with its query parameters.
+type Target struct {
+	Service      string   // The service name without the query parameters.
+	Tags         []string // Tags the nodes must have.
+	Datacenter   string   // Datacenter of the service.
+	Near         string   // The node which the nodes are sorted by the estimated rtt from.
+	LoadBalancer string   // Load balancing strategy.
+	PassingOnly  bool     // Whether consul returns only the passing nodes.
+	Filter       string   // Filter expression of the nodes.
+}
+
+// maxCachedTargets is the max number of the targets cached, the targets beyond it are parsed on each call.
+const maxCachedTargets = 1024
+
+// targets caches the parsed targets keyed by the service name with the query parameters,
+// the invalid ones are not cached.
+var targets = struct {
+	sync.RWMutex
+	parsed map[string]*Target
+}{parsed: make(map[string]*Target)}
+
+// ParseTarget parses the query parameters of the service name, the result is cached.
+func ParseTarget(serviceName string) (*Target, error) {
+	targets.RLock()
+	target, ok := targets.parsed[serviceName]
+	targets.RUnlock()
+	if ok {
+		return target, nil
+	}
+	target, err := parseTarget(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	targets.Lock()
+	if len(targets.parsed) < maxCachedTargets {
+		targets.parsed[serviceName] = target
+	}
+	targets.Unlock()
+	return target, nil
+}
+
+// parseTarget parses the query parameters of the service name, unknown parameters are rejected.
+func parseTarget(serviceName string) (*Target, error) {
+	service, rawQuery, found := strings.Cut(serviceName, "?")
+	target := &Target{Service: service}
+	if !found {
+		return target, nil
+	}
+	if service == "" {
+		return nil, fmt.Errorf("target %s: empty service name", serviceName)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", serviceName, err)
+	}
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case ParamTag:
+			target.Tags = values
+		case ParamDatacenter:
+			target.Datacenter = value
+		case ParamNear:
+			target.Near = value
+		case ParamLoadBalancer:
+			target.LoadBalancer = value
+		case ParamPassing:
+			if target.PassingOnly, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("target %s: invalid %s: %w", serviceName, ParamPassing, err)
+			}
+		case ParamFilter:
+			target.Filter = value
+		default:
+			return nil, fmt.Errorf("target %s: unknown parameter %s", serviceName, key)
+		}
+	}
+	return target, nil
+}
+
+// serviceName returns the service name without the query parameters.
+func serviceName(name string) string {
+	service, _, _ := strings.Cut(name, "?")
+	return service
+}
+
+// queryOptions sets the query options of the target parameters.
+func (t *Target) queryOptions(q *api.QueryOptions) {
+	if t.Datacenter != "" {
+		q.Datacenter = t.Datacenter
+	}
+	if t.Near != "" {
+		q.Near = t.Near
+	}
+	if t.Filter != "" {
+		q.Filter = t.Filter
+	}
+}
+
+// healthService queries the service entries of the target by the health endpoint of consul.
+func (t *Target) healthService(client *api.Client, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta,
+	error) {
+	if len(t.Tags) > 1 {
+		return client.Health().ServiceMultipleTags(t.Service, t.Tags, t.PassingOnly, q)
+	}
+	var tag string
+	if len(t.Tags) == 1 {
+		tag = t.Tags[0]
+	}
+	return client.Health().Service(t.Service, tag, t.PassingOnly, q)
+}
@@ -0,0 +1,119 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestParseTarget(t *testing.T) {
+	Convey("解析服务名中的参数", t, func() {
+		target, err := ParseTarget("test")
+		So(err, ShouldBeNil)
+		So(target, ShouldResemble, &Target{Service: "test"})
+
+		name := "test?tag=v2&dc=sh&near=_agent&lb=consistent_hash&passing=true&filter=Service.Meta.env%3D%3Dprod"
+		target, err = ParseTarget(name)
+		So(err, ShouldBeNil)
+		So(target, ShouldResemble, &Target{
+			Service:      "test",
+			Tags:         []string{"v2"},
+			Datacenter:   "sh",
+			Near:         "_agent",
+			LoadBalancer: "consistent_hash",
+			PassingOnly:  true,
+			Filter:       "Service.Meta.env==prod",
+		})
+		// The result is cached.
+		cached, _ := ParseTarget(name)
+		So(cached, ShouldEqual, target)
+
+		target, err = ParseTarget("test?tag=v2&tag=canary")
+		So(err, ShouldBeNil)
+		So(target.Tags, ShouldResemble, []string{"v2", "canary"})
+
+		_, err = ParseTarget("test?unknown=1")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTarget("test?passing=maybe")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTarget("?tag=v2")
+		So(err, ShouldNotBeNil)
+		_, _, err = (&Discovery{}).ListAll("test?unknown=1")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("缓存有上限且不缓存解析失败的服务名", t, func() {
+		defer func() {
+			targets.Lock()
+			targets.parsed = make(map[string]*Target)
+			targets.Unlock()
+		}()
+		_, _ = ParseTarget("test?unknown=2")
+		targets.RLock()
+		_, ok := targets.parsed["test?unknown=2"]
+		targets.RUnlock()
+		So(ok, ShouldBeFalse)
+
+		for i := 0; i < maxCachedTargets+10; i++ {
+			_, err := ParseTarget(fmt.Sprintf("test?tag=v%d", i))
+			So(err, ShouldBeNil)
+		}
+		targets.RLock()
+		So(len(targets.parsed), ShouldEqual, maxCachedTargets)
+		targets.RUnlock()
+		target, err := ParseTarget(fmt.Sprintf("test?tag=v%d", maxCachedTargets+20))
+		So(err, ShouldBeNil)
+		So(target.Tags, ShouldResemble, []string{fmt.Sprintf("v%d", maxCachedTargets+20)})
+	})
+	Convey("参数传递给consul查询", t, func() {
+		var (
+			service, tag string
+			passingOnly  bool
+			query        api.QueryOptions
+		)
+		patches := ApplyMethod(reflect.TypeOf(client.Health()), "Service", func(h *api.Health, s, t string,
+			p bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			service, tag, passingOnly, query = s, t, p, *q
+			return []*api.ServiceEntry{newTestEntry("1", 1000, 10)}, &api.QueryMeta{LastIndex: 1}, nil
+		})
+		defer patches.Reset()
+
+		opts := &Options{client: client, near: NearAgent}
+		_, _, err := healthService(context.Background(), opts, "test?tag=v2&dc=sh&passing=true&filter=a",
+			opts.queryOptions())
+		So(err, ShouldBeNil)
+		So(service, ShouldEqual, "test")
+		So(tag, ShouldEqual, "v2")
+		So(passingOnly, ShouldBeTrue)
+		So(query.Datacenter, ShouldEqual, "sh")
+		So(query.Filter, ShouldEqual, "a")
+		So(query.Near, ShouldEqual, NearAgent)
+
+		_, _, err = healthService(context.Background(), opts, "test", opts.queryOptions())
+		So(err, ShouldBeNil)
+		So(tag, ShouldBeEmpty)
+		So(passingOnly, ShouldBeFalse)
+		So(query.Datacenter, ShouldBeEmpty)
+
+		name, ok := preparedQueryName("query/test?dc=sh")
+		So(ok, ShouldBeTrue)
+		So(name, ShouldEqual, "test")
+	})
+}
@@ -14,74 +14,184 @@
 package discovery
 
 import (
+	"context"
 	"errors"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+	"trpc.group/trpc-go/trpc-go/log"
 )
 
 var (
 	emptyServiceEntry = make([]*api.ServiceEntry, 0)
 )
 
+const (
+	defaultWaitTime             = 5 * time.Minute
+	defaultMaxConcurrentQueries = 256
+	defaultRetryInterval        = time.Second
+	defaultMaxRetryInterval     = time.Minute
+	defaultMinQueryInterval     = time.Second
+	// The wait time and the retry interval are added at most 1/fraction of them randomly,
+	// so that the queries of the services do not go to consul at the same time.
+	waitTimeJitterFraction      = 16
+	retryIntervalJitterFraction = 2
+)
+
 // watchResult packages consul change notification.
 type watchResult struct {
 	serviceName      string
 	Version          uint64
 	healthyEntries   []*api.ServiceEntry
 	unhealthyEntries []*api.ServiceEntry
+	// reset is true if the consul index has gone backwards, the result replaces the cache regardless of the index.
+	reset bool
+	meta  *api.QueryMeta
 }
 
-// serviceWatcher watches service changes.
+// fetchFunc fetches the service entries from consul, it blocks until the index changes if index is not 0.
+type fetchFunc func(ctx context.Context, index uint64) ([]*api.ServiceEntry, *api.QueryMeta, error)
+
+// serviceWatcher watches service changes with blocking queries.
 type serviceWatcher struct {
 	serviceName string
-	plan        *watch.Plan
-	resultChan  chan *watchResult
+	cw          *consulWatcher
+	fetch       fetchFunc
+	cancel      context.CancelFunc
 }
 
 // newServiceWatcher watches new service.
-func newServiceWatcher(serviceName string, resultChan chan *watchResult) *serviceWatcher {
-	return &serviceWatcher{
+func newServiceWatcher(serviceName string, cw *consulWatcher) *serviceWatcher {
+	sw := &serviceWatcher{
 		serviceName: serviceName,
-		resultChan:  resultChan,
+		cw:          cw,
 	}
+	sw.fetch = cw.fetchFunc(sw)
+	return sw
 }
 
-// serviceHandler handles consul service changes.
-func (sw *serviceWatcher) serviceHandler(idx uint64, data interface{}) {
-	entries, ok := data.([]*api.ServiceEntry)
-	if !ok {
-		return
-	}
-	if len(entries) == 0 {
-		sw.resultChan <- &watchResult{
-			serviceName:      sw.serviceName,
-			Version:          idx,
-			healthyEntries:   emptyServiceEntry,
-			unhealthyEntries: emptyServiceEntry,
+// run runs blocking queries until ctx is done. The index is reset when it goes backwards, errors are retried
+// with exponential backoff, and queries are rate limited by the min query interval.
+func (sw *serviceWatcher) run(ctx context.Context) {
+	var (
+		index    uint64
+		failures int
+	)
+	for {
+		start := time.Now()
+		entries, meta, err := sw.query(ctx, index)
+		if ctx.Err() != nil {
+			return
 		}
-		return
+		if sw.cw.syncHandler != nil {
+			sw.cw.syncHandler(sw.serviceName, meta, err)
+		}
+		if err != nil {
+			failures++
+			retry := sw.cw.retryInterval(failures)
+			log.Warnf("Discovery::serviceWatcher failed to watch service:%s, retry in %s, err: %s",
+				sw.serviceName, retry, err)
+			if !sleep(ctx, retry) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		reset := meta.LastIndex < index
+		if reset {
+			// The index goes backwards, such as consul servers are restored from a snapshot, start over.
+			index = 0
+		}
+		if index == 0 || meta.LastIndex != index {
+			sw.handle(meta, entries, reset)
+		}
+		index = meta.LastIndex
+		if index < 1 {
+			index = 1
+		}
+		if !sleep(ctx, sw.cw.opts.minQueryInterval-time.Since(start)) {
+			return
+		}
+	}
+}
+
+// query queries the service with a blocking query, it takes a slot of the max concurrent queries.
+func (sw *serviceWatcher) query(ctx context.Context, index uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	select {
+	case sw.cw.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	defer func() { <-sw.cw.sem }()
+	return sw.fetch(ctx, index)
+}
+
+// health fetches the service entries by the health endpoint of consul.
+func (sw *serviceWatcher) health(ctx context.Context, index uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	opts := sw.cw.opts.serviceOptions(sw.serviceName)
+	queryOpts := opts.queryOptions()
+	queryOpts.WaitIndex = index
+	queryOpts.WaitTime = jitter(opts.waitTime, waitTimeJitterFraction)
+	return healthService(ctx, opts, sw.serviceName, queryOpts)
+}
+
+// healthService queries the service entries by the health endpoint of consul, with the query parameters of
+// the service name. A stale result from a server which has not contacted the leader for longer than the max age
+// is read again from the leader without blocking.
+func healthService(ctx context.Context, opts *Options, serviceName string,
+	queryOpts *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	target, err := ParseTarget(serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	target.queryOptions(queryOpts)
+	entries, meta, err := target.healthService(opts.client, queryOpts.WithContext(ctx))
+	if err != nil || !queryOpts.AllowStale || opts.maxAge <= 0 || meta.LastContact <= opts.maxAge {
+		return entries, meta, err
 	}
-	var healthEntries, unhealthyEntries []*api.ServiceEntry
+	log.Debugf("Discovery::healthService stale result of service:%s, last contact %s, read from the leader",
+		serviceName, meta.LastContact)
+	leaderOpts := *queryOpts
+	leaderOpts.AllowStale = false
+	leaderOpts.UseCache = false
+	leaderOpts.MaxAge = 0
+	leaderOpts.WaitIndex = 0
+	return target.healthService(opts.client, leaderOpts.WithContext(ctx))
+}
+
+// handle handles consul service changes.
+func (sw *serviceWatcher) handle(meta *api.QueryMeta, entries []*api.ServiceEntry, reset bool) {
+	healthyEntries, unhealthyEntries := splitEntries(entries)
+	sw.cw.publish(&watchResult{
+		serviceName:      sw.serviceName,
+		Version:          meta.LastIndex,
+		meta:             meta,
+		healthyEntries:   healthyEntries,
+		unhealthyEntries: unhealthyEntries,
+		reset:            reset,
+	})
+}
+
+// splitEntries splits service entries into healthy and unhealthy ones by the aggregated status of their checks.
+// The warning ones are healthy, which are served with the warning weight, the critical and maintenance ones are
+// unhealthy.
+func splitEntries(entries []*api.ServiceEntry) (healthyEntries, unhealthyEntries []*api.ServiceEntry) {
 	for _, service := range entries {
-		if service.Checks.AggregatedStatus() == api.HealthPassing {
-			healthEntries = append(healthEntries, service)
+		if status := service.Checks.AggregatedStatus(); status == api.HealthPassing || status == api.HealthWarning {
+			healthyEntries = append(healthyEntries, service)
 		} else {
 			unhealthyEntries = append(unhealthyEntries, service)
 		}
 	}
-	if len(healthEntries) == 0 {
-		healthEntries = emptyServiceEntry
+	if len(healthyEntries) == 0 {
+		healthyEntries = emptyServiceEntry
 	}
 	if len(unhealthyEntries) == 0 {
 		unhealthyEntries = emptyServiceEntry
 	}
-	sw.resultChan <- &watchResult{
-		serviceName:      sw.serviceName,
-		Version:          idx,
-		healthyEntries:   healthEntries,
-		unhealthyEntries: unhealthyEntries,
-	}
+	return healthyEntries, unhealthyEntries
 }
 
 // consulWatcher watches consul changes.
@@ -90,37 +200,145 @@ type consulWatcher struct {
 	serviceWatcher map[string]*serviceWatcher
 	resultChan     chan *watchResult
 	exit           chan bool
+	// syncHandler is called with the result of every query to consul.
+	syncHandler func(serviceName string, meta *api.QueryMeta, err error)
+	// fetchFunc returns how the service watcher fetches the service entries.
+	fetchFunc func(sw *serviceWatcher) fetchFunc
+	// sem limits the number of concurrent blocking queries.
+	sem    chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Running service watchers and the dispatcher.
+	wg sync.WaitGroup
+
+	// The latest results not dispatched yet of each service, a newer result replaces the older one,
+	// so that a slow consumer never blocks the watchers.
+	mu      sync.Mutex
+	pending map[string]*watchResult
+	notify  chan struct{}
 }
 
 // newConsulWatcher for creating a new consul.
 func newConsulWatcher(options ...Option) (*consulWatcher, error) {
-	opts := &Options{}
+	opts := &Options{
+		waitTime:              defaultWaitTime,
+		maxConcurrentQueries:  defaultMaxConcurrentQueries,
+		retryInterval:         defaultRetryInterval,
+		maxRetryInterval:      defaultMaxRetryInterval,
+		minQueryInterval:      defaultMinQueryInterval,
+		preparedQueryInterval: defaultPreparedQueryInterval,
+	}
 	for _, o := range options {
 		o(opts)
 	}
 	if opts.client == nil {
 		return nil, errors.New("consul client can not be nil")
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	cw := &consulWatcher{
 		opts:           opts,
 		exit:           make(chan bool),
 		serviceWatcher: make(map[string]*serviceWatcher),
 		resultChan:     make(chan *watchResult),
+		sem:            make(chan struct{}, opts.maxConcurrentQueries),
+		ctx:            ctx,
+		cancel:         cancel,
+		pending:        make(map[string]*watchResult),
+		notify:         make(chan struct{}, 1),
+		fetchFunc: func(sw *serviceWatcher) fetchFunc {
+			if name, ok := preparedQueryName(sw.serviceName); ok {
+				return sw.preparedQuery(name)
+			}
+			return sw.health
+		},
 	}
+	cw.dispatch()
 	return cw, nil
 }
 
 // watchService watches service changes.
 func (cw *consulWatcher) watchService(serviceName string) {
-	sw := newServiceWatcher(serviceName, cw.resultChan)
-	wp, _ := watch.Parse(map[string]interface{}{
-		"type":    "service",
-		"service": serviceName,
-	})
-	wp.Handler = sw.serviceHandler
-	go wp.RunWithClientAndHclog(cw.opts.client, nil)
-	sw.plan = wp
-	cw.serviceWatcher[serviceName] = sw
+	if _, ok := cw.serviceWatcher[serviceName]; ok {
+		return
+	}
+	cw.start(newServiceWatcher(serviceName, cw))
+}
+
+// start starts running the service watcher.
+func (cw *consulWatcher) start(sw *serviceWatcher) {
+	ctx, cancel := context.WithCancel(cw.ctx)
+	sw.cancel = cancel
+	cw.wg.Add(1)
+	go func() {
+		defer cw.wg.Done()
+		sw.run(ctx)
+	}()
+	cw.serviceWatcher[sw.serviceName] = sw
+}
+
+// unwatchService stops watching service changes.
+func (cw *consulWatcher) unwatchService(serviceName string) {
+	sw, ok := cw.serviceWatcher[serviceName]
+	if !ok {
+		return
+	}
+	sw.cancel()
+	delete(cw.serviceWatcher, serviceName)
+}
+
+// publish stores the result to be dispatched.
+func (cw *consulWatcher) publish(result *watchResult) {
+	cw.mu.Lock()
+	if pending, ok := cw.pending[result.serviceName]; ok && pending.reset {
+		// The index reset must not be lost when the result is replaced.
+		result.reset = true
+	}
+	cw.pending[result.serviceName] = result
+	cw.mu.Unlock()
+	select {
+	case cw.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch sends the pending results to the result channel until the watcher is stopped.
+func (cw *consulWatcher) dispatch() {
+	cw.wg.Add(1)
+	go func() {
+		defer cw.wg.Done()
+		for {
+			select {
+			case <-cw.exit:
+				return
+			case <-cw.notify:
+			}
+			for {
+				results := cw.takePending()
+				if len(results) == 0 {
+					break
+				}
+				for _, result := range results {
+					select {
+					case cw.resultChan <- result:
+					case <-cw.exit:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// takePending takes out all the pending results.
+func (cw *consulWatcher) takePending() []*watchResult {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	results := make([]*watchResult, 0, len(cw.pending))
+	for serviceName, result := range cw.pending {
+		results = append(results, result)
+		delete(cw.pending, serviceName)
+	}
+	return results
 }
 
 // watch returns consul changes.
@@ -128,6 +346,18 @@ func (cw *consulWatcher) watch() <-chan *watchResult {
 	return cw.resultChan
 }
 
+// retryInterval returns the interval before retrying after the failures, it grows exponentially with jitter.
+func (cw *consulWatcher) retryInterval(failures int) time.Duration {
+	interval := cw.opts.retryInterval
+	for i := 1; i < failures && interval < cw.opts.maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > cw.opts.maxRetryInterval {
+		interval = cw.opts.maxRetryInterval
+	}
+	return jitter(interval, retryIntervalJitterFraction)
+}
+
 // Stop listening to consul changes.
 func (cw *consulWatcher) stop() {
 	select {
@@ -135,11 +365,29 @@ func (cw *consulWatcher) stop() {
 		return
 	default:
 		close(cw.exit)
-		for _, watcher := range cw.serviceWatcher {
-			if watcher.plan == nil {
-				continue
-			}
-			watcher.plan.Stop()
-		}
+		cw.cancel()
+	}
+}
+
+// jitter adds a random duration of at most d/fraction to d.
+func jitter(d time.Duration, fraction int64) time.Duration {
+	if d <= 0 || fraction <= 0 || int64(d)/fraction <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/fraction))
+}
+
+// sleep sleeps for d, it returns false if ctx is done before that.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -14,8 +14,14 @@
 package discovery
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	. "github.com/agiledragon/gomonkey"
 	. "github.com/glycerine/goconvey/convey"
 	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/consul/api"
@@ -28,6 +34,10 @@ func Test_newConsulWatcher(t *testing.T) {
 		watcher, err := newConsulWatcher(WithClient(client))
 		So(err, ShouldBeNil)
 		So(watcher, ShouldNotBeNil)
+		watcher.stop()
+
+		_, err = newConsulWatcher()
+		So(err, ShouldNotBeNil)
 	})
 }
 
@@ -38,9 +48,18 @@ func Test_consulWatcher_watchService(t *testing.T) {
 		watcher, err := newConsulWatcher(WithClient(client))
 		So(err, ShouldBeNil)
 		So(watcher, ShouldNotBeNil)
+		defer watcher.stop()
 		watcher.watchService("test")
 
 		So(watcher.serviceWatcher["test"], ShouldNotBeNil)
+		result := <-watcher.watch()
+		So(result.serviceName, ShouldEqual, "test")
+		So(result.Version, ShouldEqual, 1)
+		So(len(result.healthyEntries), ShouldEqual, 1)
+		So(len(result.unhealthyEntries), ShouldEqual, 1)
+
+		watcher.unwatchService("test")
+		So(watcher.serviceWatcher["test"], ShouldBeNil)
 	})
 }
 
@@ -51,9 +70,11 @@ func Test_consulWatcher_stop(t *testing.T) {
 		watcher, err := newConsulWatcher(WithClient(client))
 		So(err, ShouldBeNil)
 		So(watcher, ShouldNotBeNil)
+		watcher.watchService("test")
 
 		watcher.stop()
 		watcher.stop()
+		watcher.wg.Wait()
 	})
 }
 
@@ -64,6 +85,7 @@ func Test_consulWatcher_watch(t *testing.T) {
 		watcher, err := newConsulWatcher(WithClient(client))
 		So(err, ShouldBeNil)
 		So(watcher, ShouldNotBeNil)
+		defer watcher.stop()
 		watcher.resultChan = make(chan *watchResult, 1)
 		tmp := &api.ServiceEntry{Service: &api.AgentService{}}
 		tmp.Service.Meta = make(map[string]string)
@@ -82,11 +104,53 @@ func Test_consulWatcher_watch(t *testing.T) {
 	})
 }
 
-func Test_serviceWatcher_serviceHandler(t *testing.T) {
+func Test_consulWatcher_publish(t *testing.T) {
+	Convey("未消费的变更被合并", t, func() {
+		watcher, err := newConsulWatcher(WithClient(client))
+		So(err, ShouldBeNil)
+		defer watcher.stop()
+		watcher.publish(&watchResult{serviceName: "test", Version: 1})
+		watcher.publish(&watchResult{serviceName: "test1", Version: 1})
+		watcher.publish(&watchResult{serviceName: "test", Version: 2})
+		// The dispatcher may have taken the first result before it is replaced.
+		versions := make(map[string]uint64)
+		for versions["test"] != 2 || versions["test1"] != 1 {
+			select {
+			case result := <-watcher.watch():
+				versions[result.serviceName] = result.Version
+			case <-time.After(time.Second):
+				t.Fatal("result not received")
+			}
+		}
+		select {
+		case result := <-watcher.watch():
+			t.Fatalf("unexpected result %+v", result)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+	Convey("合并时保留index回退标记", t, func() {
+		watcher, err := newConsulWatcher(WithClient(client))
+		So(err, ShouldBeNil)
+		watcher.stop()
+		// The dispatcher is stopped, so that the results stay pending.
+		watcher.wg.Wait()
+		watcher.publish(&watchResult{serviceName: "test", Version: 3, reset: true})
+		watcher.publish(&watchResult{serviceName: "test", Version: 4})
+		results := watcher.takePending()
+		So(len(results), ShouldEqual, 1)
+		So(results[0].Version, ShouldEqual, 4)
+		So(results[0].reset, ShouldBeTrue)
+	})
+}
+
+func Test_serviceWatcher_handle(t *testing.T) {
 	Convey("测试server watch变更", t, func() {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		watcher := newServiceWatcher("test", make(chan *watchResult, 1))
+		cw, err := newConsulWatcher(WithClient(client))
+		So(err, ShouldBeNil)
+		defer cw.stop()
+		watcher := newServiceWatcher("test", cw)
 		So(watcher, ShouldNotBeNil)
 		tmp := &api.ServiceEntry{Service: &api.AgentService{}}
 		tmp.Service.Meta = make(map[string]string)
@@ -95,16 +159,207 @@ func Test_serviceWatcher_serviceHandler(t *testing.T) {
 		tmp.Service.Address = "8.8.8.8"
 		tmp.Service.Port = 1000
 		tmp.Service.Weights.Passing = 10
-		watcher.serviceHandler(1, []*api.ServiceEntry{tmp})
+		watcher.handle(&api.QueryMeta{LastIndex: 1}, []*api.ServiceEntry{tmp}, false)
 
-		result := <-watcher.resultChan
+		result := <-cw.watch()
 		So(result, ShouldNotBeNil)
+		So(len(result.healthyEntries), ShouldEqual, 1)
+		So(len(result.unhealthyEntries), ShouldEqual, 0)
 
-		watcher.serviceHandler(2, []*api.ServiceEntry{})
-
-		result = <-watcher.resultChan
+		watcher.handle(&api.QueryMeta{LastIndex: 2}, []*api.ServiceEntry{}, false)
+		result = <-cw.watch()
 		So(result, ShouldNotBeNil)
-		watcher.serviceHandler(2, nil)
+		So(result.healthyEntries, ShouldNotBeNil)
+		So(result.unhealthyEntries, ShouldNotBeNil)
+
+		// Warning nodes are healthy, critical and maintenance ones are unhealthy.
+		entries := make([]*api.ServiceEntry, 0, 4)
+		for i, status := range []string{api.HealthPassing, api.HealthWarning, api.HealthCritical, api.HealthMaint} {
+			entry := newTestEntry(status, 1000+i, 10)
+			entry.Checks = api.HealthChecks{&api.HealthCheck{Status: status}}
+			entries = append(entries, entry)
+		}
+		healthy, unhealthy := splitEntries(entries)
+		So(len(healthy), ShouldEqual, 2)
+		So(healthy[1].Service.ID, ShouldEqual, api.HealthWarning)
+		So(len(unhealthy), ShouldEqual, 2)
+	})
+}
+
+// fakeFetch returns the queued responses of consul in order, and blocks when they are used up.
+type fakeFetch struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	indexes   []uint64
+}
+
+type fakeResponse struct {
+	index uint64
+	err   error
+}
+
+func (f *fakeFetch) fetch(ctx context.Context, index uint64) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	f.mu.Lock()
+	f.indexes = append(f.indexes, index)
+	if len(f.responses) == 0 {
+		f.mu.Unlock()
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+	r := f.responses[0]
+	f.responses = f.responses[1:]
+	f.mu.Unlock()
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return []*api.ServiceEntry{newTestEntry("1", 1000, 10)}, &api.QueryMeta{LastIndex: r.index}, nil
+}
+
+func (f *fakeFetch) waitingIndexes() []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]uint64(nil), f.indexes...)
+}
+
+func Test_serviceWatcher_run(t *testing.T) {
+	Convey("阻塞查询处理index回退和错误重试", t, func() {
+		var (
+			mu     sync.Mutex
+			synced []error
+		)
+		cw, err := newConsulWatcher(WithClient(client),
+			WithMinQueryInterval(time.Millisecond), WithRetryInterval(time.Millisecond, 4*time.Millisecond))
+		So(err, ShouldBeNil)
+		cw.syncHandler = func(serviceName string, _ *api.QueryMeta, err error) {
+			mu.Lock()
+			synced = append(synced, err)
+			mu.Unlock()
+		}
+		queryErr := errors.New("connection refused")
+		f := &fakeFetch{responses: []fakeResponse{
+			{index: 10},
+			{index: 10}, // The wait time elapses without change.
+			{err: queryErr},
+			{index: 12},
+			{index: 5}, // The index goes backwards.
+			{index: 0},
+		}}
+		sw := newServiceWatcher("test", cw)
+		sw.fetch = f.fetch
+		cw.start(sw)
+
+		var versions []uint64
+		for len(versions) < 4 {
+			select {
+			case result := <-cw.watch():
+				versions = append(versions, result.Version)
+			case <-time.After(time.Second):
+				t.Fatal("result not received")
+			}
+		}
+		So(versions, ShouldResemble, []uint64{10, 12, 5, 0})
+		for len(f.waitingIndexes()) < 7 {
+			time.Sleep(time.Millisecond)
+		}
+		So(f.waitingIndexes(), ShouldResemble, []uint64{0, 10, 10, 10, 12, 5, 1})
+		cw.stop()
+		cw.wg.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		So(synced, ShouldResemble, []error{nil, nil, queryErr, nil, nil, nil})
+	})
+}
+
+func Test_consulWatcher_retryInterval(t *testing.T) {
+	Convey("错误重试指数退避", t, func() {
+		cw, err := newConsulWatcher(WithClient(client), WithRetryInterval(time.Second, 10*time.Second))
+		So(err, ShouldBeNil)
+		defer cw.stop()
+		for failures, interval := range map[int]time.Duration{
+			1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second,
+			100: 10 * time.Second,
+		} {
+			retry := cw.retryInterval(failures)
+			So(retry, ShouldBeGreaterThanOrEqualTo, interval)
+			So(retry, ShouldBeLessThanOrEqualTo, interval+interval/retryIntervalJitterFraction)
+		}
+	})
+}
+
+func Test_consulWatcher_maxConcurrentQueries(t *testing.T) {
+	Convey("限制并发查询数", t, func() {
+		cw, err := newConsulWatcher(WithClient(client), WithMaxConcurrentQueries(1))
+		So(err, ShouldBeNil)
+		f1 := &fakeFetch{}
+		sw1 := newServiceWatcher("test1", cw)
+		sw1.fetch = f1.fetch
+		cw.start(sw1)
+		for len(f1.waitingIndexes()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		f2 := &fakeFetch{}
+		sw2 := newServiceWatcher("test2", cw)
+		sw2.fetch = f2.fetch
+		cw.start(sw2)
+		time.Sleep(50 * time.Millisecond)
+		So(len(f2.waitingIndexes()), ShouldEqual, 0)
+
+		cw.unwatchService("test1")
+		for len(f2.waitingIndexes()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cw.stop()
+		cw.wg.Wait()
 	})
+}
 
+func Test_healthService(t *testing.T) {
+	Convey("stale模式下过旧的结果从leader重新读取", t, func() {
+		var queries []api.QueryOptions
+		patches := ApplyMethod(reflect.TypeOf(client.Health()), "Service", func(h *api.Health, service, tag string,
+			passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			queries = append(queries, *q)
+			if q.AllowStale {
+				return []*api.ServiceEntry{newTestEntry("stale", 1000, 10)},
+					&api.QueryMeta{LastIndex: 9, LastContact: time.Minute}, nil
+			}
+			return []*api.ServiceEntry{newTestEntry("leader", 1000, 10)},
+				&api.QueryMeta{LastIndex: 10, KnownLeader: true}, nil
+		})
+		defer patches.Reset()
+
+		opts := &Options{client: client, consistency: ConsistencyStale, maxAge: 10 * time.Second, useCache: true}
+		q := opts.queryOptions()
+		So(q.AllowStale, ShouldBeTrue)
+		So(q.RequireConsistent, ShouldBeFalse)
+		So(q.UseCache, ShouldBeTrue)
+		So(q.MaxAge, ShouldEqual, 10*time.Second)
+		q.WaitIndex = 8
+		entries, meta, err := healthService(context.Background(), opts, "test", q)
+		So(err, ShouldBeNil)
+		So(entries[0].Service.ID, ShouldEqual, "leader")
+		So(meta.LastIndex, ShouldEqual, 10)
+		So(len(queries), ShouldEqual, 2)
+		So(queries[1].AllowStale, ShouldBeFalse)
+		So(queries[1].UseCache, ShouldBeFalse)
+		So(queries[1].WaitIndex, ShouldEqual, 0)
+
+		// Fresh enough.
+		queries = nil
+		opts.maxAge = 2 * time.Minute
+		entries, _, err = healthService(context.Background(), opts, "test", opts.queryOptions())
+		So(err, ShouldBeNil)
+		So(entries[0].Service.ID, ShouldEqual, "stale")
+		So(len(queries), ShouldEqual, 1)
+
+		// Not stale mode.
+		queries = nil
+		opts.consistency = ConsistencyConsistent
+		q = opts.queryOptions()
+		So(q.RequireConsistent, ShouldBeTrue)
+		entries, _, err = healthService(context.Background(), opts, "test", q)
+		So(err, ShouldBeNil)
+		So(entries[0].Service.ID, ShouldEqual, "leader")
+		So(len(queries), ShouldEqual, 1)
+	})
 }
@@ -18,6 +18,14 @@ import "errors"
 var (
 	// ServerNotAvailableError service unavailable, no nodes available.
 	ServerNotAvailableError = errors.New("server can not available")
+	// ServiceNotFoundError the service does not exist in consul or has no nodes at all.
+	ServiceNotFoundError = errors.New("service not found")
+	// NoMatchedNodeError no node matches the routing rule whose fallback policy is fail.
+	NoMatchedNodeError = errors.New("no node matches the routing rule")
 	// BalancerNotExistError there is no corresponding load balancing strategy.
 	BalancerNotExistError = errors.New("load balancer is not exist")
+	// DiscoveryClosedError discovery has been closed.
+	DiscoveryClosedError = errors.New("discovery is closed")
+	// StaleNodesError consul has been unreachable for longer than the max staleness, the nodes are not served.
+	StaleNodesError = errors.New("service nodes are staler than the max staleness")
 )
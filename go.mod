@@ -8,6 +8,7 @@ require (
 	github.com/golang/mock v1.4.4
 	github.com/hashicorp/consul/api v1.8.1
 	github.com/stretchr/testify v1.8.0
+	go.uber.org/goleak v1.2.1
 	golang.org/x/sync v0.1.0
 	trpc.group/trpc-go/trpc-go v1.0.0
 )
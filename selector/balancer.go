@@ -0,0 +1,56 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"trpc.group/trpc-go/trpc-go/naming/bannednodes"
+	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// selectUnbanned selects a node by choose among the nodes not banned by the context, such as the nodes tried
+// by the retries and hedging before, the selected node is banned afterwards. All the nodes are used if all are
+// banned and the ban is not mandatory.
+func selectUnbanned(nodes []*tregistry.Node, opts []loadbalance.Option,
+	choose func([]*tregistry.Node) *tregistry.Node) (*tregistry.Node, error) {
+	if len(nodes) == 0 {
+		return nil, loadbalance.ErrNoServerAvailable
+	}
+	var o loadbalance.Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Ctx == nil {
+		return choose(nodes), nil
+	}
+	bans, mandatory, ok := bannednodes.FromCtx(o.Ctx)
+	if !ok {
+		return choose(nodes), nil
+	}
+	candidates := make([]*tregistry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if bans.Range(func(n *tregistry.Node) bool { return n.Address != node.Address }) {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		if mandatory {
+			return nil, loadbalance.ErrNoServerAvailable
+		}
+		candidates = nodes
+	}
+	node := choose(candidates)
+	bannednodes.Add(o.Ctx, node)
+	return node, nil
+}
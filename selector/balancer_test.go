@@ -0,0 +1,57 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/glycerine/goconvey/convey"
+	"trpc.group/trpc-go/trpc-go/naming/bannednodes"
+	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+func Test_selectUnbanned(t *testing.T) {
+	first := func(nodes []*tregistry.Node) *tregistry.Node { return nodes[0] }
+	Convey("跳过已经尝试过的节点", t, func() {
+		nodes := newTestNodes("test", "a", "b")
+		node, err := selectUnbanned(nodes, nil, first)
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "a")
+
+		ctx := bannednodes.NewCtx(context.Background(), true)
+		opts := []loadbalance.Option{loadbalance.WithContext(ctx)}
+		node, err = selectUnbanned(nodes, opts, first)
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "a")
+		node, err = selectUnbanned(nodes, opts, first)
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "b")
+		_, err = selectUnbanned(nodes, opts, first)
+		So(err, ShouldEqual, loadbalance.ErrNoServerAvailable)
+
+		// All the nodes are used if the ban is not mandatory.
+		ctx = bannednodes.NewCtx(context.Background(), false)
+		opts = []loadbalance.Option{loadbalance.WithContext(ctx)}
+		_, _ = selectUnbanned(nodes, opts, first)
+		_, _ = selectUnbanned(nodes, opts, first)
+		node, err = selectUnbanned(nodes, opts, first)
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "a")
+
+		_, err = selectUnbanned(nil, nil, first)
+		So(err, ShouldEqual, loadbalance.ErrNoServerAvailable)
+	})
+}
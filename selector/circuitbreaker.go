@@ -0,0 +1,236 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"sync"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+const (
+	defaultErrorRate           = 0.5
+	defaultMinRequests         = 10
+	defaultConsecutiveFailures = 5
+	defaultBreakerWindow       = 10 * time.Second
+	defaultRecoveryWindow      = 30 * time.Second
+
+	// Breakers of nodes closed and not reported for the idle time are removed.
+	breakerIdleTime      = time.Hour
+	breakerSweepInterval = time.Minute
+)
+
+// CircuitBreakerOptions circuit breaker configuration, zero values are replaced by the defaults.
+type CircuitBreakerOptions struct {
+	// ErrorRate opens the breaker if the failure rate in the window reaches it, 0.5 by default.
+	ErrorRate float64
+	// MinRequests is the min number of requests in the window before the error rate is checked, 10 by default.
+	MinRequests int
+	// ConsecutiveFailures opens the breaker if the node fails consecutively for the times, 5 by default.
+	ConsecutiveFailures int
+	// SlowThreshold counts a call taking longer than it as a failure, 0 means never.
+	SlowThreshold time.Duration
+	// Window is the window of counting the error rate, 10s by default.
+	Window time.Duration
+	// RecoveryWindow is how long the breaker stays open before a probe is let through, 30s by default.
+	RecoveryWindow time.Duration
+}
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker is the circuit breaker of a node.
+type circuitBreaker struct {
+	state breakerState
+	// Statistics of the current window.
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	// The time the breaker opened, and the time the probe was let through when half open.
+	openedAt time.Time
+	probedAt time.Time
+	// The last time the node was reported.
+	reportedAt time.Time
+}
+
+// circuitBreakers are the circuit breakers of all nodes, keyed by the service name and the address of the node.
+type circuitBreakers struct {
+	opts CircuitBreakerOptions
+
+	mu        sync.Mutex
+	breakers  map[string]*circuitBreaker
+	lastSweep time.Time
+}
+
+// newCircuitBreakers creates the circuit breakers.
+func newCircuitBreakers(opts CircuitBreakerOptions) *circuitBreakers {
+	if opts.ErrorRate <= 0 {
+		opts.ErrorRate = defaultErrorRate
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = defaultMinRequests
+	}
+	if opts.ConsecutiveFailures <= 0 {
+		opts.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultBreakerWindow
+	}
+	if opts.RecoveryWindow <= 0 {
+		opts.RecoveryWindow = defaultRecoveryWindow
+	}
+	return &circuitBreakers{
+		opts:     opts,
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+// breakerKey returns the key of the circuit breaker of the node.
+func breakerKey(node *tregistry.Node) string {
+	return node.ServiceName + "/" + node.Address
+}
+
+// filter returns the nodes whose breakers let calls through. A half open node is let through if its probe is not
+// in flight. All nodes are returned if none is let through, so that the service is never cut off entirely.
+func (b *circuitBreakers) filter(nodes []*tregistry.Node) []*tregistry.Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.breakers) == 0 {
+		return nodes
+	}
+	now := time.Now()
+	available := make([]*tregistry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if b.allowLocked(b.breakers[breakerKey(node)], now) {
+			available = append(available, node)
+		}
+	}
+	if len(available) == 0 {
+		return nodes
+	}
+	return available
+}
+
+// allowLocked reports whether the breaker lets calls through, must guarded by lock.
+func (b *circuitBreakers) allowLocked(cb *circuitBreaker, now time.Time) bool {
+	if cb == nil {
+		return true
+	}
+	switch cb.state {
+	case breakerOpen:
+		if now.Sub(cb.openedAt) < b.opts.RecoveryWindow {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.probedAt = time.Time{}
+		return true
+	case breakerHalfOpen:
+		// A probe not reported within the recovery window is considered lost.
+		return cb.probedAt.IsZero() || now.Sub(cb.probedAt) >= b.opts.RecoveryWindow
+	default:
+		return true
+	}
+}
+
+// selected marks the probe of the half open node in flight.
+func (b *circuitBreakers) selected(node *tregistry.Node) {
+	if node == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cb, ok := b.breakers[breakerKey(node)]; ok && cb.state == breakerHalfOpen {
+		cb.probedAt = time.Now()
+	}
+}
+
+// report records the result of a call to the node.
+func (b *circuitBreakers) report(node *tregistry.Node, cost time.Duration, err error) {
+	if node == nil {
+		return
+	}
+	failed := err != nil || (b.opts.SlowThreshold > 0 && cost > b.opts.SlowThreshold)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.sweepLocked(now)
+	key := breakerKey(node)
+	cb, ok := b.breakers[key]
+	if !ok {
+		if !failed {
+			// Nodes never failed need no breakers.
+			return
+		}
+		cb = &circuitBreaker{windowStart: now}
+		b.breakers[key] = cb
+	}
+	cb.reportedAt = now
+
+	switch cb.state {
+	case breakerOpen:
+		// Calls selected before the breaker opened.
+		return
+	case breakerHalfOpen:
+		if failed {
+			b.openLocked(cb, now)
+			return
+		}
+		*cb = circuitBreaker{windowStart: now, reportedAt: now}
+		return
+	}
+
+	if now.Sub(cb.windowStart) >= b.opts.Window {
+		cb.windowStart, cb.requests, cb.failures = now, 0, 0
+	}
+	cb.requests++
+	if !failed {
+		cb.consecutive = 0
+		return
+	}
+	cb.failures++
+	cb.consecutive++
+	if cb.consecutive >= b.opts.ConsecutiveFailures ||
+		(cb.requests >= b.opts.MinRequests && float64(cb.failures)/float64(cb.requests) >= b.opts.ErrorRate) {
+		b.openLocked(cb, now)
+	}
+}
+
+// openLocked opens the breaker, must guarded by lock.
+func (b *circuitBreakers) openLocked(cb *circuitBreaker, now time.Time) {
+	cb.state = breakerOpen
+	cb.openedAt = now
+	cb.probedAt = time.Time{}
+	cb.windowStart, cb.requests, cb.failures, cb.consecutive = now, 0, 0, 0
+}
+
+// sweepLocked removes the closed breakers not reported for the idle time, must guarded by lock.
+func (b *circuitBreakers) sweepLocked(now time.Time) {
+	if now.Sub(b.lastSweep) < breakerSweepInterval {
+		return
+	}
+	b.lastSweep = now
+	for key, cb := range b.breakers {
+		if cb.state == breakerClosed && now.Sub(cb.reportedAt) > breakerIdleTime {
+			delete(b.breakers, key)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+)
+
+// newTestNodes returns the nodes of the service at the addresses.
+func newTestNodes(serviceName string, addresses ...string) []*tregistry.Node {
+	nodes := make([]*tregistry.Node, 0, len(addresses))
+	for _, address := range addresses {
+		nodes = append(nodes, &tregistry.Node{ServiceName: serviceName, Address: address, Weight: 10,
+			Metadata: map[string]interface{}{}})
+	}
+	return nodes
+}
+
+func Test_circuitBreakers(t *testing.T) {
+	callErr := errors.New("timeout")
+	Convey("连续失败熔断", t, func() {
+		b := newCircuitBreakers(CircuitBreakerOptions{ConsecutiveFailures: 3, RecoveryWindow: time.Hour})
+		nodes := newTestNodes("test", "a", "b")
+		for i := 0; i < 2; i++ {
+			b.report(nodes[0], time.Millisecond, callErr)
+		}
+		b.report(nodes[0], time.Millisecond, nil)
+		b.report(nodes[0], time.Millisecond, callErr)
+		So(len(b.filter(nodes)), ShouldEqual, 2)
+		b.report(nodes[0], time.Millisecond, callErr)
+		b.report(nodes[0], time.Millisecond, callErr)
+		So(b.filter(nodes), ShouldResemble, nodes[1:])
+		// All nodes are returned if all of them are open.
+		for i := 0; i < 3; i++ {
+			b.report(nodes[1], time.Millisecond, callErr)
+		}
+		So(b.filter(nodes), ShouldResemble, nodes)
+	})
+	Convey("错误率熔断", t, func() {
+		b := newCircuitBreakers(CircuitBreakerOptions{ErrorRate: 0.5, MinRequests: 4, ConsecutiveFailures: 100,
+			RecoveryWindow: time.Hour})
+		nodes := newTestNodes("test", "a", "b")
+		b.report(nodes[0], time.Millisecond, callErr)
+		b.report(nodes[0], time.Millisecond, nil)
+		b.report(nodes[0], time.Millisecond, nil)
+		So(len(b.filter(nodes)), ShouldEqual, 2)
+		b.report(nodes[0], time.Millisecond, callErr)
+		So(b.filter(nodes), ShouldResemble, nodes[1:])
+	})
+	Convey("慢调用视为失败", t, func() {
+		b := newCircuitBreakers(CircuitBreakerOptions{ConsecutiveFailures: 2, SlowThreshold: time.Second,
+			RecoveryWindow: time.Hour})
+		nodes := newTestNodes("test", "a", "b")
+		b.report(nodes[0], 2*time.Second, nil)
+		b.report(nodes[0], 2*time.Second, nil)
+		So(b.filter(nodes), ShouldResemble, nodes[1:])
+	})
+	Convey("半开探测", t, func() {
+		b := newCircuitBreakers(CircuitBreakerOptions{ConsecutiveFailures: 1, RecoveryWindow: 10 * time.Millisecond})
+		nodes := newTestNodes("test", "a", "b")
+		b.report(nodes[0], time.Millisecond, callErr)
+		So(b.filter(nodes), ShouldResemble, nodes[1:])
+		time.Sleep(20 * time.Millisecond)
+		// A probe is let through after the recovery window.
+		So(len(b.filter(nodes)), ShouldEqual, 2)
+		b.selected(nodes[0])
+		So(b.filter(nodes), ShouldResemble, nodes[1:])
+		// The failed probe opens it again.
+		b.report(nodes[0], time.Millisecond, callErr)
+		So(b.filter(nodes), ShouldResemble, nodes[1:])
+		time.Sleep(20 * time.Millisecond)
+		So(len(b.filter(nodes)), ShouldEqual, 2)
+		b.selected(nodes[0])
+		// The succeeded probe closes it.
+		b.report(nodes[0], time.Millisecond, nil)
+		So(len(b.filter(nodes)), ShouldEqual, 2)
+		So(b.breakers[breakerKey(nodes[0])].state, ShouldEqual, breakerClosed)
+	})
+	Convey("清理空闲的熔断器", t, func() {
+		b := newCircuitBreakers(CircuitBreakerOptions{})
+		nodes := newTestNodes("test", "a")
+		b.report(nodes[0], time.Millisecond, nil)
+		So(len(b.breakers), ShouldEqual, 0)
+		b.report(nodes[0], time.Millisecond, callErr)
+		So(len(b.breakers), ShouldEqual, 1)
+		b.sweepLocked(time.Now().Add(2 * breakerIdleTime))
+		So(len(b.breakers), ShouldEqual, 0)
+	})
+}
+
+func TestSelector_circuitBreaker(t *testing.T) {
+	Convey("Select排除熔断的节点", t, func() {
+		nodes := newTestNodes("test", "a", "b")
+		d := &discovery.Discovery{}
+		discovery.DefaultDiscovery = d
+		patches := ApplyMethod(reflect.TypeOf(d), "List", func(d *discovery.Discovery,
+			service string, opt ...tdiscovery.Option) ([]*tregistry.Node, error) {
+			return nodes, nil
+		})
+		defer patches.Reset()
+
+		s := New(WithLoadBalancer("random"), WithCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1}))
+		So(s.Report(nodes[0], time.Millisecond, errors.New("timeout")), ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			So(node.Address, ShouldEqual, "b")
+		}
+	})
+}
+
+func TestSelector_preparedQueryCircuitBreaker(t *testing.T) {
+	Convey("prepared query 的被调熔断配置", t, func() {
+		entries := []api.ServiceEntry{*newTestEntry(1000, api.HealthPassing, nil),
+			*newTestEntry(1001, api.HealthPassing, nil)}
+		patches := ApplyMethod(reflect.TypeOf(&api.PreparedQuery{}), "Execute", func(_ *api.PreparedQuery,
+			name string, _ *api.QueryOptions) (*api.PreparedQueryExecuteResponse, *api.QueryMeta, error) {
+			return &api.PreparedQueryExecuteResponse{Service: "test", Nodes: entries}, &api.QueryMeta{}, nil
+		})
+		defer patches.Reset()
+		d, closeDiscovery := newTestDiscovery()
+		defer closeDiscovery()
+
+		s := New(WithDiscovery(d), WithServices(map[string]*ServiceOptions{
+			"query/helloworld": {CircuitBreaker: &CircuitBreakerOptions{ConsecutiveFailures: 1, RecoveryWindow: time.Hour}},
+		}))
+		node, err := s.Select("query/helloworld")
+		So(err, ShouldBeNil)
+		So(node.ServiceName, ShouldEqual, "test")
+		So(node.Metadata[discovery.MetaCallee], ShouldEqual, "query/helloworld")
+		// The failure is reported to the breakers of the callee the node is selected by.
+		_ = s.Report(node, time.Millisecond, errors.New("timeout"))
+		for i := 0; i < 100; i++ {
+			selected, err := s.Select("query/helloworld")
+			So(err, ShouldBeNil)
+			So(selected.Address, ShouldNotEqual, node.Address)
+		}
+	})
+}
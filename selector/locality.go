@@ -0,0 +1,144 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"os"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+)
+
+const (
+	// ZoneEnv and DatacenterEnv are the environment variables of the zone and the datacenter of the caller,
+	// which are used if they are not configured.
+	ZoneEnv       = "CONSUL_ZONE"
+	DatacenterEnv = "CONSUL_DATACENTER"
+
+	defaultZoneKey           = "zone"
+	defaultLocalityThreshold = 0.7
+)
+
+// Locality levels of the nodes from the caller.
+const (
+	localZone = iota
+	localDatacenter
+	remoteDatacenter
+	localityLevels
+)
+
+// LocalityOptions locality-aware load balancing configuration.
+type LocalityOptions struct {
+	// Zone and Datacenter are the zone and the datacenter of the caller, the environment variables ZoneEnv
+	// and DatacenterEnv are used if they are empty. Locality is disabled if the zone is unknown.
+	Zone       string
+	Datacenter string
+	// ZoneKey is the key of the zone in the node metadata, "zone" by default.
+	ZoneKey string
+	// Threshold is the ratio of healthy nodes of a locality, below which the traffic spills over to the next
+	// locality in proportion to the healthy ratio, 0.7 by default.
+	Threshold float64
+}
+
+// locality routes the traffic to the nodes in the same zone first, then other zones in the same datacenter,
+// and then other datacenters, by the capacity of each locality.
+type locality struct {
+	opts LocalityOptions
+	rand *safeRand
+}
+
+// newLocality creates the locality-aware routing.
+func newLocality(opts LocalityOptions) *locality {
+	if opts.Zone == "" {
+		opts.Zone = os.Getenv(ZoneEnv)
+	}
+	if opts.Datacenter == "" {
+		opts.Datacenter = os.Getenv(DatacenterEnv)
+	}
+	if opts.ZoneKey == "" {
+		opts.ZoneKey = defaultZoneKey
+	}
+	if opts.Threshold <= 0 || opts.Threshold > 1 {
+		opts.Threshold = defaultLocalityThreshold
+	}
+	return &locality{
+		opts: opts,
+		rand: newSafeRand(),
+	}
+}
+
+// enabled reports whether the zone of the caller is known.
+func (l *locality) enabled() bool {
+	return l.opts.Zone != ""
+}
+
+// level returns the locality level of the node from the caller.
+func (l *locality) level(node *tregistry.Node) int {
+	datacenter, _ := node.Metadata[discovery.MetaDatacenter].(string)
+	if l.opts.Datacenter != "" && datacenter != "" && datacenter != l.opts.Datacenter {
+		return remoteDatacenter
+	}
+	if zone, _ := node.Metadata[l.opts.ZoneKey].(string); zone == l.opts.Zone {
+		return localZone
+	}
+	return localDatacenter
+}
+
+// filter picks the nodes of a locality randomly by their shares of the traffic. A locality takes all the traffic
+// left if its healthy ratio reaches the threshold, otherwise it takes the part in proportion to the ratio, and
+// the rest spills over to the next locality. The unhealthy nodes only count in the capacity.
+func (l *locality) filter(healthy, unhealthy []*tregistry.Node) []*tregistry.Node {
+	var (
+		levels [localityLevels][]*tregistry.Node
+		totals [localityLevels]int
+	)
+	for _, node := range healthy {
+		level := l.level(node)
+		levels[level] = append(levels[level], node)
+		totals[level]++
+	}
+	for _, node := range unhealthy {
+		totals[l.level(node)]++
+	}
+
+	var shares [localityLevels]float64
+	remaining := 1.0
+	for i := range levels {
+		if len(levels[i]) == 0 {
+			continue
+		}
+		availability := float64(len(levels[i])) / float64(totals[i]) / l.opts.Threshold
+		if availability > 1 {
+			availability = 1
+		}
+		if availability > remaining {
+			availability = remaining
+		}
+		shares[i] = availability
+		remaining -= availability
+	}
+	// The traffic left when all localities are short of capacity is shared in proportion.
+	total := 1 - remaining
+	if total <= 0 {
+		return healthy
+	}
+	r := l.rand.Float64() * total
+	for i := range levels {
+		if r < shares[i] {
+			return levels[i]
+		}
+		r -= shares[i]
+	}
+	return healthy
+}
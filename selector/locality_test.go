@@ -0,0 +1,167 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+)
+
+func newLocalityNodes(datacenter, zone string, addresses ...string) []*tregistry.Node {
+	nodes := newTestNodes("test", addresses...)
+	for _, n := range nodes {
+		n.Metadata[discovery.MetaDatacenter] = datacenter
+		n.Metadata["zone"] = zone
+	}
+	return nodes
+}
+
+func Test_locality(t *testing.T) {
+	Convey("调用方 zone 未知时不开启", t, func() {
+		os.Unsetenv(ZoneEnv)
+		So(newLocality(LocalityOptions{}).enabled(), ShouldBeFalse)
+		os.Setenv(ZoneEnv, "sz1")
+		defer os.Unsetenv(ZoneEnv)
+		l := newLocality(LocalityOptions{})
+		So(l.enabled(), ShouldBeTrue)
+		So(l.opts.Zone, ShouldEqual, "sz1")
+		So(l.opts.ZoneKey, ShouldEqual, defaultZoneKey)
+		So(l.opts.Threshold, ShouldEqual, defaultLocalityThreshold)
+	})
+	Convey("节点的 locality 级别", t, func() {
+		l := newLocality(LocalityOptions{Zone: "sz1", Datacenter: "dc1"})
+		So(l.level(newLocalityNodes("dc1", "sz1", "a")[0]), ShouldEqual, localZone)
+		So(l.level(newLocalityNodes("dc1", "sz2", "a")[0]), ShouldEqual, localDatacenter)
+		So(l.level(newLocalityNodes("dc2", "sz1", "a")[0]), ShouldEqual, remoteDatacenter)
+		So(l.level(newLocalityNodes("", "sz1", "a")[0]), ShouldEqual, localZone)
+	})
+	Convey("同 zone 容量充足时只访问同 zone", t, func() {
+		l := newLocality(LocalityOptions{Zone: "sz1", Datacenter: "dc1"})
+		local := newLocalityNodes("dc1", "sz1", "a", "b", "c")
+		healthy := append(append([]*tregistry.Node{}, local...), newLocalityNodes("dc1", "sz2", "d")...)
+		unhealthy := newLocalityNodes("dc1", "sz1", "e")
+		for i := 0; i < 100; i++ {
+			So(l.filter(healthy, unhealthy), ShouldResemble, local)
+		}
+	})
+	Convey("同 zone 容量不足时按比例溢出", t, func() {
+		l := newLocality(LocalityOptions{Zone: "sz1", Datacenter: "dc1", Threshold: 0.8})
+		healthy := append(newLocalityNodes("dc1", "sz1", "a"), newLocalityNodes("dc1", "sz2", "b")...)
+		healthy = append(healthy, newLocalityNodes("dc2", "sz3", "c")...)
+		// Half of the local zone is healthy, which takes 0.5/0.8 of the traffic.
+		unhealthy := newLocalityNodes("dc1", "sz1", "d")
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			nodes := l.filter(healthy, unhealthy)
+			So(len(nodes), ShouldEqual, 1)
+			counts[nodes[0].Address]++
+		}
+		So(counts["a"], ShouldBeBetween, 5800, 6700)
+		So(counts["b"], ShouldBeBetween, 3300, 4200)
+		So(counts["c"], ShouldEqual, 0)
+	})
+	Convey("同数据中心容量不足时溢出到其他数据中心", t, func() {
+		l := newLocality(LocalityOptions{Zone: "sz1", Datacenter: "dc1"})
+		healthy := newLocalityNodes("dc2", "sz3", "c")
+		unhealthy := newLocalityNodes("dc1", "sz1", "a", "b")
+		for i := 0; i < 100; i++ {
+			So(l.filter(healthy, unhealthy), ShouldResemble, healthy)
+		}
+	})
+}
+
+func TestSelector_locality(t *testing.T) {
+	Convey("同 zone 的不健康节点来自服务发现时按比例溢出", t, func() {
+		d, closeDiscovery := newTestDiscovery(
+			newTestEntry(1000, api.HealthPassing, map[string]string{"zone": "sz1"}),
+			newTestEntry(1001, api.HealthCritical, map[string]string{"zone": "sz1"}),
+			newTestEntry(1002, api.HealthPassing, map[string]string{"zone": "sz2"}),
+		)
+		defer closeDiscovery()
+
+		s := New(WithDiscovery(d), WithLocality(LocalityOptions{Zone: "sz1", Threshold: 0.8}))
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			counts[node.Address]++
+		}
+		// Half of the local zone is healthy, which takes 0.5/0.8 of the traffic.
+		So(counts["8.8.8.8:1000"], ShouldBeBetween, 5800, 6700)
+		So(counts["8.8.8.8:1002"], ShouldBeBetween, 3300, 4200)
+		So(counts["8.8.8.8:1001"], ShouldEqual, 0)
+	})
+}
+
+func TestSelector_localityFiltered(t *testing.T) {
+	entry := func(port int, status, zone, tag string) *api.ServiceEntry {
+		e := newTestEntry(port, status, map[string]string{"zone": zone})
+		e.Service.Tags = []string{tag}
+		return e
+	}
+	Convey("有标签的被调按过滤后的节点计算容量", t, func() {
+		var entries []*api.ServiceEntry
+		for i := 0; i < 5; i++ {
+			entries = append(entries, entry(1000+i, api.HealthPassing, "sz1", "v2"),
+				entry(1100+i, api.HealthPassing, "sz1", "v1"), entry(1200+i, api.HealthCritical, "sz1", "v1"))
+		}
+		entries = append(entries, entry(2000, api.HealthPassing, "sz2", "v2"))
+		d, closeDiscovery := newTestDiscovery(entries...)
+		defer closeDiscovery()
+
+		s := New(WithDiscovery(d), WithLocality(LocalityOptions{Zone: "sz1"}),
+			WithServices(map[string]*ServiceOptions{"test": {Tags: []string{"v2"}}}))
+		for i := 0; i < 1000; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			So(node.Metadata["zone"], ShouldEqual, "sz1")
+			So(node.Metadata[discovery.MetaTags], ShouldResemble, []string{"v2"})
+		}
+	})
+	Convey("熔断的节点不计入容量", t, func() {
+		d, closeDiscovery := newTestDiscovery(
+			entry(1000, api.HealthPassing, "sz1", "v1"),
+			entry(1001, api.HealthPassing, "sz1", "v1"),
+			entry(2000, api.HealthPassing, "sz2", "v1"),
+		)
+		defer closeDiscovery()
+
+		s := New(WithDiscovery(d), WithLocality(LocalityOptions{Zone: "sz1", Threshold: 0.8}),
+			WithCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1, RecoveryWindow: time.Hour}))
+		nodes, err := d.List("test")
+		So(err, ShouldBeNil)
+		for _, node := range nodes {
+			if node.Address == "8.8.8.8:1000" {
+				_ = s.Report(node, time.Millisecond, errors.New("timeout"))
+			}
+		}
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			counts[node.Address]++
+		}
+		// Half of the local zone is available, which takes 0.5/0.8 of the traffic.
+		So(counts["8.8.8.8:1000"], ShouldEqual, 0)
+		So(counts["8.8.8.8:1001"], ShouldBeBetween, 5800, 6700)
+		So(counts["8.8.8.8:2000"], ShouldBeBetween, 3300, 4200)
+	})
+}
@@ -0,0 +1,47 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"sort"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+)
+
+// nearestNodes returns the nearest n nodes by the rtt estimated by discovery, all nodes if n is not positive.
+// Nodes without the estimated rtt keep the order of consul after those with it.
+func nearestNodes(nodes []*tregistry.Node, n int) []*tregistry.Node {
+	if n <= 0 || len(nodes) <= n {
+		return nodes
+	}
+	sorted := make([]*tregistry.Node, len(nodes))
+	copy(sorted, nodes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, iok := nodeRTT(sorted[i])
+		rj, jok := nodeRTT(sorted[j])
+		if iok != jok {
+			return iok
+		}
+		return ri < rj
+	})
+	return sorted[:n]
+}
+
+// nodeRTT returns the rtt of the node estimated by discovery, false if it is unknown.
+func nodeRTT(node *tregistry.Node) (time.Duration, bool) {
+	rtt, ok := node.Metadata[discovery.MetaRTT].(time.Duration)
+	return rtt, ok
+}
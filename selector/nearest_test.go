@@ -0,0 +1,53 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+)
+
+func Test_nearestNodes(t *testing.T) {
+	Convey("选取最近的n个节点", t, func() {
+		node := func(address string, rtt time.Duration) *tregistry.Node {
+			n := &tregistry.Node{Address: address, Metadata: map[string]interface{}{}}
+			if rtt > 0 {
+				n.Metadata[discovery.MetaRTT] = rtt
+			}
+			return n
+		}
+		nodes := []*tregistry.Node{
+			node("unknown", 0),
+			node("far", 100*time.Millisecond),
+			node("near", time.Millisecond),
+			node("middle", 10*time.Millisecond),
+		}
+		addresses := func(nodes []*tregistry.Node) []string {
+			var result []string
+			for _, n := range nodes {
+				result = append(result, n.Address)
+			}
+			return result
+		}
+		So(addresses(nearestNodes(nodes, 2)), ShouldResemble, []string{"near", "middle"})
+		So(addresses(nearestNodes(nodes, 4)), ShouldResemble, []string{"unknown", "far", "near", "middle"})
+		So(addresses(nearestNodes(nodes, 0)), ShouldResemble, []string{"unknown", "far", "near", "middle"})
+		// The nodes of discovery are not modified.
+		So(nodes[0].Address, ShouldEqual, "unknown")
+	})
+}
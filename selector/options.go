@@ -13,9 +13,26 @@
 
 package selector
 
+import "trpc.group/trpc-go/trpc-naming-consul/discovery"
+
 // Options selector configuration
 type Options struct {
-	LoadBalancer string // load balancing strategy
+	// Discovery looks up the nodes, nil means discovery.DefaultDiscovery.
+	Discovery    *discovery.Discovery
+	LoadBalancer string // load balancing strategy, weighted_random by default
+	Nearest      int    // select among the nearest n nodes, 0 means all nodes
+	// CircuitBreaker configuration, nil means no circuit breaker.
+	CircuitBreaker *CircuitBreakerOptions
+	// OutlierDetection configuration, nil means no outlier detection.
+	OutlierDetection *OutlierDetectionOptions
+	// RoutingRules filter the nodes by the caller in order.
+	RoutingRules []RoutingRule
+	// Locality configuration, nil means no locality-aware load balancing.
+	Locality *LocalityOptions
+	// SlowStart configuration, nil means no slow start.
+	SlowStart *SlowStartOptions
+	// Services are the configuration of each callee overriding the global one.
+	Services map[string]*ServiceOptions
 }
 
 // Option function for setting options.
@@ -30,3 +47,63 @@ func WithLoadBalancer(loadBalancer string) Option {
 
 	}
 }
+
+// WithDiscovery sets the discovery looking up the nodes, which is of the consul cluster of the selector.
+func WithDiscovery(d *discovery.Discovery) Option {
+	return func(options *Options) {
+		options.Discovery = d
+	}
+}
+
+// WithNearest sets selecting among the nearest n nodes by the rtt estimated by discovery, which works with the near
+// option of discovery. Nodes without the estimated rtt are considered farthest.
+func WithNearest(n int) Option {
+	return func(options *Options) {
+		options.Nearest = n
+	}
+}
+
+// WithCircuitBreaker enables the circuit breaker of each node fed by the results reported.
+func WithCircuitBreaker(opts CircuitBreakerOptions) Option {
+	return func(options *Options) {
+		options.CircuitBreaker = &opts
+	}
+}
+
+// WithOutlierDetection enables detecting outliers among the nodes of each service by the results reported,
+// the outliers are ejected from selecting for a while.
+func WithOutlierDetection(opts OutlierDetectionOptions) Option {
+	return func(options *Options) {
+		options.OutlierDetection = &opts
+	}
+}
+
+// WithRoutingRules sets the rules filtering the nodes by matching the caller against the node metadata.
+func WithRoutingRules(rules []RoutingRule) Option {
+	return func(options *Options) {
+		options.RoutingRules = rules
+	}
+}
+
+// WithSlowStart enables ramping the weights of new nodes up in the window, which works with the balancers
+// honouring the node weights.
+func WithSlowStart(opts SlowStartOptions) Option {
+	return func(options *Options) {
+		options.SlowStart = &opts
+	}
+}
+
+// WithServices sets the configuration of each callee, which overrides the global one.
+func WithServices(services map[string]*ServiceOptions) Option {
+	return func(options *Options) {
+		options.Services = services
+	}
+}
+
+// WithLocality enables locality-aware load balancing, which prefers the nodes in the same zone as the caller,
+// and spills over to other zones and then other datacenters when the local capacity is short.
+func WithLocality(opts LocalityOptions) Option {
+	return func(options *Options) {
+		options.Locality = &opts
+	}
+}
@@ -0,0 +1,285 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+const (
+	defaultOutlierInterval        = 10 * time.Second
+	defaultOutlierMinRequests     = 20
+	defaultOutlierMinHosts        = 3
+	defaultSuccessRateStdevFactor = 1.9
+	defaultLatencyFactor          = 3
+	defaultBaseEjectionTime       = 30 * time.Second
+	defaultMaxEjectionTime        = 5 * time.Minute
+	defaultMaxEjectionPercent     = 10
+)
+
+// OutlierDetectionOptions outlier detection configuration, zero values are replaced by the defaults.
+type OutlierDetectionOptions struct {
+	// Interval is the interval of detecting outliers, the statistics are reset after each detection, 10s by default.
+	Interval time.Duration
+	// MinRequests is the min number of requests of a node in the interval to be detected, 20 by default.
+	MinRequests int
+	// MinHosts is the min number of nodes with enough requests to detect outliers among them, 3 by default.
+	MinHosts int
+	// SuccessRateStdevFactor ejects the nodes whose success rate is less than
+	// mean - stdev * SuccessRateStdevFactor of all nodes, 1.9 by default.
+	SuccessRateStdevFactor float64
+	// LatencyFactor ejects the nodes whose average latency is more than LatencyFactor times the median of
+	// all nodes, 3 by default.
+	LatencyFactor float64
+	// BaseEjectionTime is the ejection time of the first ejection, it grows with the times a node is ejected,
+	// 30s by default.
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime is the max ejection time, 5m by default.
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent is the max percent of nodes ejected, at least one node can be ejected, 10 by default.
+	MaxEjectionPercent int
+}
+
+// outlierHost is the statistics and the ejection state of a node.
+type outlierHost struct {
+	requests  int
+	successes int
+	latency   time.Duration
+	// The times the node has been ejected, which decreases for each interval the node is not ejected.
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// outlierService is the outlier detection of the nodes of a service, keyed by the address.
+type outlierService struct {
+	hosts       map[string]*outlierHost
+	evaluatedAt time.Time
+}
+
+// outlierDetector detects outliers among the nodes of each service by the results reported, and ejects them
+// from selecting for a while.
+type outlierDetector struct {
+	opts OutlierDetectionOptions
+
+	mu       sync.Mutex
+	services map[string]*outlierService
+}
+
+// newOutlierDetector creates the outlier detector.
+func newOutlierDetector(opts OutlierDetectionOptions) *outlierDetector {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultOutlierInterval
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = defaultOutlierMinRequests
+	}
+	if opts.MinHosts <= 0 {
+		opts.MinHosts = defaultOutlierMinHosts
+	}
+	if opts.SuccessRateStdevFactor <= 0 {
+		opts.SuccessRateStdevFactor = defaultSuccessRateStdevFactor
+	}
+	if opts.LatencyFactor <= 0 {
+		opts.LatencyFactor = defaultLatencyFactor
+	}
+	if opts.BaseEjectionTime <= 0 {
+		opts.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if opts.MaxEjectionTime <= 0 {
+		opts.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	if opts.MaxEjectionPercent <= 0 {
+		opts.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return &outlierDetector{
+		opts:     opts,
+		services: make(map[string]*outlierService),
+	}
+}
+
+// report records the result of a call to the node.
+func (d *outlierDetector) report(node *tregistry.Node, cost time.Duration, err error) {
+	if node == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[node.ServiceName]
+	if !ok {
+		s = &outlierService{hosts: make(map[string]*outlierHost), evaluatedAt: time.Now()}
+		d.services[node.ServiceName] = s
+	}
+	h, ok := s.hosts[node.Address]
+	if !ok {
+		h = &outlierHost{}
+		s.hosts[node.Address] = h
+	}
+	h.requests++
+	h.latency += cost
+	if err == nil {
+		h.successes++
+	}
+}
+
+// evaluate detects the outliers among all the nodes of the service if the interval has elapsed since the last
+// detection. The nodes are the ones listed from discovery before any filtering of the call, so that the ejection
+// percent and the statistics kept do not depend on the filters of each call.
+func (d *outlierDetector) evaluate(healthy, unhealthy []*tregistry.Node) {
+	var serviceName string
+	if len(healthy) > 0 {
+		serviceName = healthy[0].ServiceName
+	} else if len(unhealthy) > 0 {
+		serviceName = unhealthy[0].ServiceName
+	} else {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[serviceName]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.Sub(s.evaluatedAt) < d.opts.Interval {
+		return
+	}
+	current := make(map[string]bool, len(healthy)+len(unhealthy))
+	for _, nodes := range [][]*tregistry.Node{healthy, unhealthy} {
+		for _, node := range nodes {
+			current[node.Address] = true
+		}
+	}
+	d.evaluateLocked(s, current, now)
+}
+
+// filter returns the nodes not ejected, all nodes are returned if all of them are ejected.
+func (d *outlierDetector) filter(nodes []*tregistry.Node) []*tregistry.Node {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[nodes[0].ServiceName]
+	if !ok {
+		return nodes
+	}
+	now := time.Now()
+	available := make([]*tregistry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if h, ok := s.hosts[node.Address]; ok && now.Before(h.ejectedUntil) {
+			continue
+		}
+		available = append(available, node)
+	}
+	if len(available) == 0 {
+		return nodes
+	}
+	return available
+}
+
+// evaluateLocked detects the outliers among the hosts and ejects them, current is the addresses of the nodes
+// listed, must guarded by lock.
+func (d *outlierDetector) evaluateLocked(s *outlierService, current map[string]bool, now time.Time) {
+	s.evaluatedAt = now
+	total := len(current)
+	ejected := 0
+	var candidates []string
+	for address, h := range s.hosts {
+		if !current[address] {
+			if h.requests == 0 && !now.Before(h.ejectedUntil) {
+				// The node is gone, or it is not called through the service any longer.
+				delete(s.hosts, address)
+				continue
+			}
+			// The node is called through another target of the service, such as the one with a tag.
+			total++
+		}
+		if now.Before(h.ejectedUntil) {
+			ejected++
+		} else if h.ejections > 0 && h.ejectedUntil.Add(d.opts.Interval).Before(now) {
+			h.ejections--
+		}
+		if !now.Before(h.ejectedUntil) && h.requests >= d.opts.MinRequests {
+			candidates = append(candidates, address)
+		}
+	}
+
+	if len(candidates) >= d.opts.MinHosts {
+		outliers := d.outliersLocked(s, candidates)
+		maxEjected := total * d.opts.MaxEjectionPercent / 100
+		if maxEjected < 1 {
+			maxEjected = 1
+		}
+		for _, address := range outliers {
+			if ejected >= maxEjected {
+				break
+			}
+			h := s.hosts[address]
+			h.ejections++
+			ejectionTime := time.Duration(h.ejections) * d.opts.BaseEjectionTime
+			if ejectionTime > d.opts.MaxEjectionTime {
+				ejectionTime = d.opts.MaxEjectionTime
+			}
+			h.ejectedUntil = now.Add(ejectionTime)
+			ejected++
+		}
+	}
+	for _, h := range s.hosts {
+		h.requests, h.successes, h.latency = 0, 0, 0
+	}
+}
+
+// outliersLocked returns the outliers among the candidates by the success rate and the latency,
+// the worst first, must guarded by lock.
+func (d *outlierDetector) outliersLocked(s *outlierService, candidates []string) []string {
+	rates := make(map[string]float64, len(candidates))
+	latencies := make([]float64, 0, len(candidates))
+	var sum float64
+	for _, address := range candidates {
+		h := s.hosts[address]
+		rates[address] = float64(h.successes) / float64(h.requests)
+		sum += rates[address]
+		latencies = append(latencies, float64(h.latency)/float64(h.requests))
+	}
+	mean := sum / float64(len(candidates))
+	var variance float64
+	for _, rate := range rates {
+		variance += (rate - mean) * (rate - mean)
+	}
+	stdev := math.Sqrt(variance / float64(len(candidates)))
+	sort.Float64s(latencies)
+	median := latencies[len(latencies)/2]
+	if len(latencies)%2 == 0 {
+		median = (latencies[len(latencies)/2-1] + median) / 2
+	}
+
+	var outliers []string
+	for _, address := range candidates {
+		h := s.hosts[address]
+		latency := float64(h.latency) / float64(h.requests)
+		if rates[address] < mean-stdev*d.opts.SuccessRateStdevFactor ||
+			(median > 0 && latency > median*d.opts.LatencyFactor) {
+			outliers = append(outliers, address)
+		}
+	}
+	sort.Slice(outliers, func(i, j int) bool {
+		return rates[outliers[i]] < rates[outliers[j]]
+	})
+	return outliers
+}
@@ -0,0 +1,200 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// reportN reports n results of the node, the first failures of which fail.
+func reportN(d *outlierDetector, node *tregistry.Node, n, failures int, cost time.Duration) {
+	for i := 0; i < n; i++ {
+		var err error
+		if i < failures {
+			err = errors.New("timeout")
+		}
+		d.report(node, cost, err)
+	}
+}
+
+// expire makes the outlier detection due.
+func expire(d *outlierDetector, serviceName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.services[serviceName].evaluatedAt = time.Time{}
+}
+
+func Test_outlierDetector(t *testing.T) {
+	Convey("剔除成功率异常的节点", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{MinRequests: 10, MaxEjectionPercent: 50})
+		nodes := newTestNodes("test", "a", "b", "c", "d", "e")
+		for _, node := range nodes[1:] {
+			reportN(d, node, 100, 0, time.Millisecond)
+		}
+		reportN(d, nodes[0], 100, 50, time.Millisecond)
+		// Not detected until the interval elapses.
+		d.evaluate(nodes, nil)
+		So(len(d.filter(nodes)), ShouldEqual, 5)
+		expire(d, "test")
+		d.evaluate(nodes, nil)
+		So(d.filter(nodes), ShouldResemble, nodes[1:])
+		So(d.services["test"].hosts["a"].ejections, ShouldEqual, 1)
+	})
+	Convey("剔除耗时异常的节点", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{MinRequests: 10, MaxEjectionPercent: 50})
+		nodes := newTestNodes("test", "a", "b", "c", "d")
+		for _, node := range nodes[1:] {
+			reportN(d, node, 10, 0, 10*time.Millisecond)
+		}
+		reportN(d, nodes[0], 10, 0, time.Second)
+		expire(d, "test")
+		d.evaluate(nodes, nil)
+		So(d.filter(nodes), ShouldResemble, nodes[1:])
+	})
+	Convey("剔除比例上限", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{MinRequests: 10, MaxEjectionPercent: 10, LatencyFactor: 2})
+		nodes := newTestNodes("test", "a", "b", "c", "d", "e", "f")
+		for _, node := range nodes[:2] {
+			reportN(d, node, 10, 0, time.Second)
+		}
+		for _, node := range nodes[2:] {
+			reportN(d, node, 10, 0, 10*time.Millisecond)
+		}
+		expire(d, "test")
+		// At least one node can be ejected.
+		d.evaluate(nodes, nil)
+		So(len(d.filter(nodes)), ShouldEqual, 5)
+	})
+	Convey("节点不足时不检测", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{MinRequests: 10})
+		nodes := newTestNodes("test", "a", "b", "c")
+		reportN(d, nodes[0], 10, 10, time.Millisecond)
+		reportN(d, nodes[1], 10, 0, time.Millisecond)
+		reportN(d, nodes[2], 5, 0, time.Millisecond)
+		expire(d, "test")
+		d.evaluate(nodes, nil)
+		So(len(d.filter(nodes)), ShouldEqual, 3)
+	})
+	Convey("剔除时间随剔除次数增长", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{MinRequests: 10, MaxEjectionPercent: 50,
+			BaseEjectionTime: time.Minute, MaxEjectionTime: 3 * time.Minute})
+		nodes := newTestNodes("test", "a", "b", "c", "d")
+		for i := 1; i <= 4; i++ {
+			for _, node := range nodes[1:] {
+				reportN(d, node, 10, 0, time.Millisecond)
+			}
+			reportN(d, nodes[0], 10, 0, time.Second)
+			expire(d, "test")
+			d.mu.Lock()
+			// The last ejection has just expired.
+			d.services["test"].hosts["a"].ejectedUntil = time.Now().Add(-time.Millisecond)
+			d.mu.Unlock()
+			before := time.Now()
+			d.evaluate(nodes, nil)
+			h := d.services["test"].hosts["a"]
+			expected := time.Duration(i) * time.Minute
+			if expected > 3*time.Minute {
+				expected = 3 * time.Minute
+			}
+			So(h.ejectedUntil.Sub(before), ShouldBeBetweenOrEqual, expected, expected+time.Second)
+		}
+	})
+	Convey("未被剔除的节点剔除次数递减", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{})
+		nodes := newTestNodes("test", "a")
+		reportN(d, nodes[0], 1, 0, time.Millisecond)
+		d.mu.Lock()
+		d.services["test"].hosts["a"].ejections = 2
+		d.services["test"].hosts["a"].ejectedUntil = time.Now().Add(-time.Hour)
+		d.mu.Unlock()
+		expire(d, "test")
+		d.evaluate(nodes, nil)
+		So(d.services["test"].hosts["a"].ejections, ShouldEqual, 1)
+	})
+	Convey("节点下线后删除统计", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{})
+		nodes := newTestNodes("test", "a", "b")
+		reportN(d, nodes[0], 1, 0, time.Millisecond)
+		reportN(d, nodes[1], 1, 0, time.Millisecond)
+		expire(d, "test")
+		// The node called in the interval is kept, it may be called through another target of the service.
+		d.evaluate(nodes[1:], nil)
+		_, ok := d.services["test"].hosts["a"]
+		So(ok, ShouldBeTrue)
+		expire(d, "test")
+		d.evaluate(nodes[1:], nil)
+		_, ok = d.services["test"].hosts["a"]
+		So(ok, ShouldBeFalse)
+	})
+	Convey("不健康节点计入剔除比例", t, func() {
+		d := newOutlierDetector(OutlierDetectionOptions{MinRequests: 10, MaxEjectionPercent: 20})
+		nodes := newTestNodes("test", "a", "b", "c", "d", "e")
+		for _, node := range nodes[2:] {
+			reportN(d, node, 10, 0, 10*time.Millisecond)
+		}
+		for _, node := range nodes[:2] {
+			reportN(d, node, 10, 0, time.Second)
+		}
+		expire(d, "test")
+		d.evaluate(nodes, newTestNodes("test", "f", "g", "h", "i", "j"))
+		// 20% of the 10 nodes can be ejected.
+		So(len(d.filter(nodes)), ShouldEqual, 3)
+	})
+}
+
+func TestSelector_outlierDetection(t *testing.T) {
+	Convey("在过滤前的全部节点中检测异常节点", t, func() {
+		var entries []*api.ServiceEntry
+		for port := 1000; port < 1010; port++ {
+			set := "sz"
+			if port >= 1005 {
+				set = "sh"
+			}
+			entries = append(entries, newTestEntry(port, api.HealthPassing, map[string]string{"set": set}))
+		}
+		d, closeDiscovery := newTestDiscovery(entries...)
+		defer closeDiscovery()
+
+		s := New(WithDiscovery(d),
+			WithOutlierDetection(OutlierDetectionOptions{MinRequests: 10, MaxEjectionPercent: 20}),
+			WithServices(map[string]*ServiceOptions{"test": {Metadata: map[string]string{"set": "sz"}}}))
+		nodes, err := d.List("test")
+		So(err, ShouldBeNil)
+		for _, node := range nodes {
+			cost := 10 * time.Millisecond
+			if node.Address == "8.8.8.8:1000" || node.Address == "8.8.8.8:1001" {
+				cost = time.Second
+			}
+			for i := 0; i < 10; i++ {
+				_ = s.Report(node, cost, nil)
+			}
+		}
+		expire(s.outliers, "test")
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			seen[node.Address] = true
+		}
+		// 20% of the 10 nodes are ejected, though only 5 of them are selected from.
+		So(seen, ShouldResemble, map[string]bool{"8.8.8.8:1002": true, "8.8.8.8:1003": true, "8.8.8.8:1004": true})
+		So(len(s.outliers.services["test"].hosts), ShouldEqual, 10)
+	})
+}
@@ -0,0 +1,180 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// LoadBalanceP2C is the name of the power of two choices balancer registered in loadbalance.
+const LoadBalanceP2C = "p2c"
+
+const (
+	// p2cDecay is the weight of the latest latency in the ewma latency.
+	p2cDecay = 0.3
+	// p2cFailurePenalty is the min latency of a failed call, so that a node failing fast does not attract calls.
+	p2cFailurePenalty = time.Second
+	// p2cProbeInterval is how long a node is not picked before it is picked anyway to refresh its latency.
+	p2cProbeInterval = 3 * time.Second
+	// p2cBaseLatency is added to the latency, so that the in-flight calls count for the nodes without latency.
+	p2cBaseLatency = float64(time.Millisecond)
+
+	// Statistics of nodes not picked for the idle time are removed.
+	p2cIdleTime      = time.Hour
+	p2cSweepInterval = time.Minute
+)
+
+func init() {
+	loadbalance.Register(LoadBalanceP2C, defaultP2C)
+}
+
+// defaultP2C is the p2c balancer shared by all selectors, which is fed by Selector.Report.
+var defaultP2C = newP2C()
+
+// p2cKey is the key of the statistics of a node.
+type p2cKey struct {
+	serviceName string
+	address     string
+}
+
+// p2cStat is the statistics of a node.
+type p2cStat struct {
+	inflight int64
+	// The unix nano time the node was picked last time.
+	pickedAt int64
+
+	mu      sync.Mutex
+	latency float64 // ewma latency in nanoseconds, 0 if unknown
+}
+
+// p2c picks two nodes randomly and selects the one with the lower load, which is the ewma latency multiplied by
+// the in-flight calls and divided by the weight. The statistics are maintained from the pairs of Select and
+// Report of the selector, so it works only with the selectors of this plugin.
+type p2c struct {
+	rand  *safeRand
+	stats sync.Map // p2cKey -> *p2cStat
+	// Whether the balancer has selected, Report is skipped before.
+	used int32
+	// The unix nano time the idle statistics were removed last time.
+	sweptAt int64
+}
+
+// newP2C creates the p2c balancer.
+func newP2C() *p2c {
+	return &p2c{rand: newSafeRand(), sweptAt: time.Now().UnixNano()}
+}
+
+// Select selects the node with the lower load of two random nodes.
+func (p *p2c) Select(serviceName string, list []*tregistry.Node,
+	opts ...loadbalance.Option) (*tregistry.Node, error) {
+	node, err := selectUnbanned(list, opts, p.choose)
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt32(&p.used, 1)
+	now := time.Now().UnixNano()
+	stat := p.stat(node)
+	atomic.AddInt64(&stat.inflight, 1)
+	atomic.StoreInt64(&stat.pickedAt, now)
+	if swept := atomic.LoadInt64(&p.sweptAt); now-swept > int64(p2cSweepInterval) &&
+		atomic.CompareAndSwapInt64(&p.sweptAt, swept, now) {
+		p.sweep(now)
+	}
+	return node, nil
+}
+
+// sweep removes the statistics of the nodes not picked for the idle time.
+func (p *p2c) sweep(now int64) {
+	p.stats.Range(func(key, value interface{}) bool {
+		stat := value.(*p2cStat)
+		if now-atomic.LoadInt64(&stat.pickedAt) > int64(p2cIdleTime) && atomic.LoadInt64(&stat.inflight) <= 0 {
+			p.stats.Delete(key)
+		}
+		return true
+	})
+}
+
+// choose chooses the node with the lower load of two random nodes, or the one not picked for long.
+func (p *p2c) choose(nodes []*tregistry.Node) *tregistry.Node {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	i := p.rand.Intn(len(nodes))
+	j := p.rand.Intn(len(nodes) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := nodes[i], nodes[j]
+	statA, statB := p.stat(a), p.stat(b)
+	if statA.load(a) > statB.load(b) {
+		a, b, statA, statB = b, a, statB, statA
+	}
+	// The node with the higher load is probed if it has not been picked for long.
+	if time.Since(time.Unix(0, atomic.LoadInt64(&statB.pickedAt))) > p2cProbeInterval {
+		return b
+	}
+	return a
+}
+
+// report updates the statistics of the node with the result of the call.
+func (p *p2c) report(node *tregistry.Node, cost time.Duration, err error) {
+	if atomic.LoadInt32(&p.used) == 0 {
+		return
+	}
+	v, ok := p.stats.Load(p2cKey{serviceName: node.ServiceName, address: node.Address})
+	if !ok {
+		return
+	}
+	stat := v.(*p2cStat)
+	if atomic.AddInt64(&stat.inflight, -1) < 0 {
+		atomic.AddInt64(&stat.inflight, 1)
+	}
+	if err != nil && cost < p2cFailurePenalty {
+		cost = p2cFailurePenalty
+	}
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+	if stat.latency == 0 {
+		stat.latency = float64(cost)
+		return
+	}
+	stat.latency = stat.latency*(1-p2cDecay) + float64(cost)*p2cDecay
+}
+
+// stat returns the statistics of the node, which is created if it does not exist.
+func (p *p2c) stat(node *tregistry.Node) *p2cStat {
+	key := p2cKey{serviceName: node.ServiceName, address: node.Address}
+	if v, ok := p.stats.Load(key); ok {
+		return v.(*p2cStat)
+	}
+	v, _ := p.stats.LoadOrStore(key, &p2cStat{pickedAt: time.Now().UnixNano()})
+	return v.(*p2cStat)
+}
+
+// load returns the load of the node.
+func (s *p2cStat) load(node *tregistry.Node) float64 {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	weight := node.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return (latency + p2cBaseLatency) * float64(atomic.LoadInt64(&s.inflight)+1) / float64(weight)
+}
@@ -0,0 +1,137 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+func Test_p2c(t *testing.T) {
+	Convey("注册p2c负载均衡", t, func() {
+		So(loadbalance.Get(LoadBalanceP2C), ShouldEqual, defaultP2C)
+	})
+	Convey("选择负载较低的节点", t, func() {
+		p := newP2C()
+		nodes := newTestNodes("test", "fast", "slow")
+		for i := 0; i < 10; i++ {
+			node, err := p.Select("test", nodes)
+			So(err, ShouldBeNil)
+			cost := time.Millisecond
+			if node.Address == "slow" {
+				cost = 100 * time.Millisecond
+			}
+			p.report(node, cost, nil)
+		}
+		// Both nodes are picked by the two choices, the lower load wins.
+		for i := 0; i < 100; i++ {
+			node, err := p.Select("test", nodes)
+			So(err, ShouldBeNil)
+			So(node.Address, ShouldEqual, "fast")
+			p.report(node, time.Millisecond, nil)
+		}
+		// The in-flight calls count in the load.
+		So(atomic.LoadInt64(&p.stat(nodes[0]).inflight), ShouldEqual, 0)
+		atomic.StoreInt64(&p.stat(nodes[0]).inflight, 1000)
+		node, _ := p.Select("test", nodes)
+		So(node.Address, ShouldEqual, "slow")
+
+		// The slow node is probed if it is not picked for long.
+		atomic.StoreInt64(&p.stat(nodes[0]).inflight, 0)
+		atomic.StoreInt64(&p.stat(nodes[1]).pickedAt, time.Now().Add(-time.Minute).UnixNano())
+		node, _ = p.Select("test", nodes)
+		So(node.Address, ShouldEqual, "slow")
+	})
+	Convey("失败调用计入惩罚耗时", t, func() {
+		p := newP2C()
+		nodes := newTestNodes("test", "a")
+		node, err := p.Select("test", nodes)
+		So(err, ShouldBeNil)
+		p.report(node, time.Millisecond, errors.New("failed"))
+		So(p.stat(node).latency, ShouldEqual, float64(p2cFailurePenalty))
+		// Reports without selecting are ignored.
+		p.report(node, time.Millisecond, nil)
+		So(atomic.LoadInt64(&p.stat(node).inflight), ShouldEqual, 0)
+		_, err = p.Select("test", nil)
+		So(err, ShouldEqual, loadbalance.ErrNoServerAvailable)
+	})
+	Convey("清理空闲节点的统计", t, func() {
+		p := newP2C()
+		nodes := newTestNodes("test", "a", "b")
+		_, _ = p.Select("test", nodes)
+		atomic.StoreInt64(&p.stat(nodes[0]).pickedAt, time.Now().Add(-2*p2cIdleTime).UnixNano())
+		atomic.StoreInt64(&p.stat(nodes[0]).inflight, 0)
+		atomic.StoreInt64(&p.sweptAt, time.Now().Add(-2*p2cSweepInterval).UnixNano())
+		_, _ = p.Select("test", nodes[1:])
+		_, ok := p.stats.Load(p2cKey{serviceName: "test", address: "a"})
+		So(ok, ShouldBeFalse)
+	})
+}
+
+// benchmarkSkewed simulates the calls to the nodes among which one is 20 times slower than the others,
+// with 32 calls in flight, and reports the mean latency and the share of the slow node.
+func benchmarkSkewed(b *testing.B, balancer loadbalance.LoadBalancer, report func(*tregistry.Node, time.Duration)) {
+	nodes := newTestNodes("skewed", "slow", "a", "b", "c", "d", "e", "f", "g", "h", "i")
+	latency := func(node *tregistry.Node) time.Duration {
+		if node.Address == "slow" {
+			return 20 * time.Millisecond
+		}
+		return time.Millisecond
+	}
+	const inflight = 32
+	var (
+		pending      []*tregistry.Node
+		total        time.Duration
+		slow, served int
+	)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		node, err := balancer.Select("skewed", nodes)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pending = append(pending, node)
+		if len(pending) < inflight {
+			continue
+		}
+		done := pending[0]
+		pending = pending[1:]
+		cost := latency(done)
+		report(done, cost)
+		total += cost
+		served++
+		if done.Address == "slow" {
+			slow++
+		}
+	}
+	if served > 0 {
+		b.ReportMetric(float64(total)/float64(served)/float64(time.Millisecond), "latency-ms")
+		b.ReportMetric(float64(slow)*100/float64(served), "slow-%")
+	}
+}
+
+func BenchmarkP2C_skewed(b *testing.B) {
+	p := newP2C()
+	benchmarkSkewed(b, p, func(node *tregistry.Node, cost time.Duration) { p.report(node, cost, nil) })
+}
+
+func BenchmarkRandom_skewed(b *testing.B) {
+	benchmarkSkewed(b, loadbalance.NewRandom(), func(*tregistry.Node, time.Duration) {})
+}
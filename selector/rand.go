@@ -0,0 +1,45 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// safeRand is a random number generator safe for concurrent use.
+type safeRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// newSafeRand creates a random number generator seeded by the current time.
+func newSafeRand() *safeRand {
+	return &safeRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Float64 returns a random number in [0, 1).
+func (r *safeRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Float64()
+}
+
+// Intn returns a random number in [0, n).
+func (r *safeRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Intn(n)
+}
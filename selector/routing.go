@@ -0,0 +1,141 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"fmt"
+	"strings"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
+)
+
+// Caller fields matched by routing rules.
+const (
+	SourceEnv                 = "source_env"
+	SourceSet                 = "source_set"
+	SourceNamespace           = "source_namespace"
+	SourceService             = "source_service"
+	DestinationEnv            = "destination_env"
+	DestinationSet            = "destination_set"
+	DestinationNamespace      = "namespace"
+	SourceMetadataPrefix      = "source_metadata."
+	DestinationMetadataPrefix = "destination_metadata."
+)
+
+// Fallback policies when no node matches a routing rule.
+const (
+	// FallbackAll ignores the rule and keeps all nodes.
+	FallbackAll = "all"
+	// FallbackFail fails the selection with NoMatchedNodeError.
+	FallbackFail = "fail"
+)
+
+// RoutingRule keeps the nodes whose metadata value of MetaKey equals the value of the caller field Source.
+// The rule is skipped if the caller field is empty.
+type RoutingRule struct {
+	// MetaKey is the key of the node metadata, such as env, set, version or region.
+	MetaKey string
+	// Source is the caller field, one of SourceEnv, SourceSet, SourceNamespace, SourceService, DestinationEnv,
+	// DestinationSet and DestinationNamespace, or SourceMetadataPrefix or DestinationMetadataPrefix followed by the metadata key.
+	Source string
+	// Fallback is the policy when no node matches, FallbackAll by default.
+	Fallback string
+}
+
+// Check checks whether the rule is valid.
+func (r RoutingRule) Check() error {
+	if r.MetaKey == "" {
+		return fmt.Errorf("routing rule of source %s has no meta key", r.Source)
+	}
+	switch r.Source {
+	case SourceEnv, SourceSet, SourceNamespace, SourceService, DestinationEnv, DestinationSet, DestinationNamespace:
+	default:
+		if !strings.HasPrefix(r.Source, SourceMetadataPrefix) && !strings.HasPrefix(r.Source, DestinationMetadataPrefix) {
+			return fmt.Errorf("routing rule of meta key %s has unknown source %s", r.MetaKey, r.Source)
+		}
+	}
+	switch r.Fallback {
+	case "", FallbackAll, FallbackFail:
+		return nil
+	default:
+		return fmt.Errorf("routing rule of meta key %s has unknown fallback %s", r.MetaKey, r.Fallback)
+	}
+}
+
+// callerValue returns the value of the caller field of the rule.
+func (r RoutingRule) callerValue(o *tselector.Options) string {
+	switch r.Source {
+	case SourceEnv:
+		return o.SourceEnvName
+	case SourceSet:
+		return o.SourceSetName
+	case SourceNamespace:
+		return o.SourceNamespace
+	case SourceService:
+		return o.SourceServiceName
+	case DestinationEnv:
+		return o.DestinationEnvName
+	case DestinationSet:
+		return o.DestinationSetName
+	case DestinationNamespace:
+		return o.Namespace
+	}
+	if strings.HasPrefix(r.Source, SourceMetadataPrefix) {
+		return o.SourceMetadata[strings.TrimPrefix(r.Source, SourceMetadataPrefix)]
+	}
+	if strings.HasPrefix(r.Source, DestinationMetadataPrefix) {
+		return o.DestinationMetadata[strings.TrimPrefix(r.Source, DestinationMetadataPrefix)]
+	}
+	return ""
+}
+
+// route filters the nodes by the rules in order.
+func route(nodes []*tregistry.Node, rules []RoutingRule, o *tselector.Options) ([]*tregistry.Node, error) {
+	nodes, _, err := routeAll(nodes, nil, rules, o)
+	return nodes, err
+}
+
+// routeAll filters the nodes by the rules in order, and the unhealthy nodes by the same rules applied to the nodes,
+// so that both of them stay the same population. Whether a rule falls back depends on the nodes only.
+func routeAll(nodes, unhealthy []*tregistry.Node, rules []RoutingRule,
+	o *tselector.Options) ([]*tregistry.Node, []*tregistry.Node, error) {
+	for _, rule := range rules {
+		value := rule.callerValue(o)
+		if value == "" {
+			continue
+		}
+		if matched := rule.match(nodes, value); len(matched) > 0 {
+			nodes = matched
+			unhealthy = rule.match(unhealthy, value)
+			continue
+		}
+		if rule.Fallback == FallbackFail {
+			return nil, nil, fmt.Errorf("%w: %s=%s", consul_error.NoMatchedNodeError, rule.MetaKey, value)
+		}
+	}
+	return nodes, unhealthy, nil
+}
+
+// match returns the nodes whose metadata of the rule is the value.
+func (r RoutingRule) match(nodes []*tregistry.Node, value string) []*tregistry.Node {
+	matched := make([]*tregistry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if v, ok := node.Metadata[r.MetaKey].(string); ok && v == value {
+			matched = append(matched, node)
+		}
+	}
+	return matched
+}
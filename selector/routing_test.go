@@ -0,0 +1,127 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
+)
+
+// newRoutingNodes returns the nodes with the env and version metadata.
+func newRoutingNodes() []*tregistry.Node {
+	nodes := newTestNodes("test", "a", "b", "c")
+	nodes[0].Metadata["env"], nodes[0].Metadata["version"] = "prod", "v1"
+	nodes[1].Metadata["env"], nodes[1].Metadata["version"] = "prod", "v2"
+	nodes[2].Metadata["env"], nodes[2].Metadata["version"] = "test", "v2"
+	return nodes
+}
+
+func Test_route(t *testing.T) {
+	addresses := func(nodes []*tregistry.Node) []string {
+		var result []string
+		for _, n := range nodes {
+			result = append(result, n.Address)
+		}
+		return result
+	}
+	Convey("按规则过滤节点", t, func() {
+		nodes := newRoutingNodes()
+		rules := []RoutingRule{
+			{MetaKey: "env", Source: SourceEnv},
+			{MetaKey: "version", Source: SourceMetadataPrefix + "version"},
+		}
+		result, err := route(nodes, rules, &tselector.Options{SourceEnvName: "prod",
+			SourceMetadata: map[string]string{"version": "v2"}})
+		So(err, ShouldBeNil)
+		So(addresses(result), ShouldResemble, []string{"b"})
+		// Rules whose caller field is empty are skipped.
+		result, err = route(nodes, rules, &tselector.Options{SourceEnvName: "prod"})
+		So(err, ShouldBeNil)
+		So(addresses(result), ShouldResemble, []string{"a", "b"})
+		result, err = route(nodes, rules, &tselector.Options{})
+		So(err, ShouldBeNil)
+		So(len(result), ShouldEqual, 3)
+	})
+	Convey("没有节点匹配时的策略", t, func() {
+		nodes := newRoutingNodes()
+		o := &tselector.Options{DestinationEnvName: "dev"}
+		result, err := route(nodes, []RoutingRule{{MetaKey: "env", Source: DestinationEnv}}, o)
+		So(err, ShouldBeNil)
+		So(len(result), ShouldEqual, 3)
+		_, err = route(nodes, []RoutingRule{{MetaKey: "env", Source: DestinationEnv, Fallback: FallbackFail}}, o)
+		So(errors.Is(err, consul_error.NoMatchedNodeError), ShouldBeTrue)
+	})
+	Convey("不健康节点按相同的规则过滤", t, func() {
+		nodes := newRoutingNodes()
+		unhealthy := newTestNodes("test", "d", "e")
+		unhealthy[0].Metadata["env"] = "prod"
+		unhealthy[1].Metadata["env"] = "test"
+		result, unhealthyResult, err := routeAll(nodes, unhealthy,
+			[]RoutingRule{{MetaKey: "env", Source: SourceEnv}}, &tselector.Options{SourceEnvName: "prod"})
+		So(err, ShouldBeNil)
+		So(addresses(result), ShouldResemble, []string{"a", "b"})
+		So(addresses(unhealthyResult), ShouldResemble, []string{"d"})
+		// The rule falls back by the healthy nodes only.
+		result, unhealthyResult, err = routeAll(nodes[2:], unhealthy,
+			[]RoutingRule{{MetaKey: "env", Source: SourceEnv}}, &tselector.Options{SourceEnvName: "prod"})
+		So(err, ShouldBeNil)
+		So(addresses(result), ShouldResemble, []string{"c"})
+		So(addresses(unhealthyResult), ShouldResemble, []string{"d", "e"})
+	})
+	Convey("规则检查", t, func() {
+		So(RoutingRule{MetaKey: "env", Source: SourceEnv}.Check(), ShouldBeNil)
+		So(RoutingRule{MetaKey: "region", Source: DestinationMetadataPrefix + "region",
+			Fallback: FallbackFail}.Check(), ShouldBeNil)
+		So(RoutingRule{Source: SourceEnv}.Check(), ShouldNotBeNil)
+		So(RoutingRule{MetaKey: "env", Source: "unknown"}.Check(), ShouldNotBeNil)
+		So(RoutingRule{MetaKey: "env", Source: SourceEnv, Fallback: "unknown"}.Check(), ShouldNotBeNil)
+	})
+}
+
+func TestSelector_route(t *testing.T) {
+	Convey("Select按路由规则寻址", t, func() {
+		nodes := newRoutingNodes()
+		d := &discovery.Discovery{}
+		discovery.DefaultDiscovery = d
+		patches := ApplyMethod(reflect.TypeOf(d), "List", func(d *discovery.Discovery,
+			service string, opt ...tdiscovery.Option) ([]*tregistry.Node, error) {
+			return nodes, nil
+		})
+		defer patches.Reset()
+
+		s := New(WithRoutingRules([]RoutingRule{{MetaKey: "env", Source: SourceEnv}}))
+		for i := 0; i < 10; i++ {
+			node, err := s.Select("test", tselector.WithSourceEnvName("test"))
+			So(err, ShouldBeNil)
+			So(node.Address, ShouldEqual, "c")
+		}
+		// The rules are ignored if the service router is disabled.
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			node, err := s.Select("test", tselector.WithSourceEnvName("test"), tselector.WithDisableServiceRouter())
+			So(err, ShouldBeNil)
+			seen[node.Address] = true
+		}
+		So(len(seen), ShouldBeGreaterThan, 1)
+	})
+}
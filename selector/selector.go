@@ -17,6 +17,7 @@ package selector
 import (
 	"time"
 
+	"trpc.group/trpc-go/trpc-go/log"
 	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
 	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
@@ -27,7 +28,13 @@ import (
 
 // Selector structure.
 type Selector struct {
-	Opts *Options // configuration
+	Opts      *Options // configuration
+	breakers  *circuitBreakers
+	outliers  *outlierDetector
+	locality  *locality
+	slowStart *slowStart
+	// Circuit breakers of the callees with their own configuration, nil if disabled.
+	serviceBreakers map[string]*circuitBreakers
 }
 
 // DefaultSelector instantiated objects by Selector structure.
@@ -37,32 +44,98 @@ var DefaultSelector *Selector
 func New(call ...Option) *Selector {
 	s := &Selector{
 		Opts: &Options{
-			LoadBalancer: "random",
+			LoadBalancer: LoadBalanceWeightedRandom,
 		},
+		serviceBreakers: make(map[string]*circuitBreakers),
 	}
 
 	for _, o := range call {
 		o(s.Opts)
 	}
+	if s.Opts.CircuitBreaker != nil {
+		s.breakers = newCircuitBreakers(*s.Opts.CircuitBreaker)
+	}
+	for serviceName, so := range s.Opts.Services {
+		if so == nil {
+			continue
+		}
+		if so.CircuitBreaker != nil {
+			s.serviceBreakers[serviceName] = newCircuitBreakers(*so.CircuitBreaker)
+		} else if so.DisableCircuitBreaker {
+			s.serviceBreakers[serviceName] = nil
+		}
+	}
+	if s.Opts.OutlierDetection != nil {
+		s.outliers = newOutlierDetector(*s.Opts.OutlierDetection)
+	}
+	if s.Opts.SlowStart != nil {
+		s.slowStart = newSlowStart(*s.Opts.SlowStart)
+	}
+	if s.Opts.Locality != nil {
+		if l := newLocality(*s.Opts.Locality); l.enabled() {
+			s.locality = l
+		}
+	}
 	return s
 
 }
 
-// Select node.
+// Select node. The service name may carry query parameters, such as service?tag=v2&lb=consistent_hash,
+// which are passed to discovery, and the lb parameter overrides the load balancing strategy configured.
 func (s *Selector) Select(serviceName string, opts ...tselector.Option) (node *tregistry.Node, err error) {
 	o := &tselector.Options{}
 	for _, opt := range opts {
 		opt(o)
 	}
-	d := discovery.DefaultDiscovery
-	nodes, err := d.List(serviceName, tdiscovery.WithContext(o.Ctx))
+	target, err := discovery.ParseTarget(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	so := s.serviceOptions(target.Service)
+	nodes, unhealthyNodes, err := s.list(serviceName, so, o)
 	if err != nil {
 		return nil, err
 	}
+	if s.outliers != nil {
+		// The outliers are detected among all the nodes of the service, regardless of the filters of the call.
+		s.outliers.evaluate(nodes, unhealthyNodes)
+	}
+	if s.slowStart != nil {
+		nodes = s.slowStart.weigh(serviceName, nodes)
+	}
+	if nodes, err = filterNodes(nodes, so); err != nil {
+		return nil, err
+	}
+	unhealthyNodes = matchNodes(unhealthyNodes, so)
+	if !o.DisableServiceRouter {
+		if nodes, unhealthyNodes, err = routeAll(nodes, unhealthyNodes, s.Opts.RoutingRules, o); err != nil {
+			return nil, err
+		}
+	}
+	available := nodes
+	if s.outliers != nil {
+		available = s.outliers.filter(available)
+	}
+	breakers := s.breakersOf(target.Service)
+	if breakers != nil {
+		available = breakers.filter(available)
+	}
+	if s.locality != nil {
+		// The unhealthy nodes and the nodes ejected count in the capacity of each locality, the unhealthy nodes
+		// are filtered the same as the healthy ones so that the capacity is of the nodes the call may select.
+		nodes = s.locality.filter(available, append(ejectedNodes(nodes, available), unhealthyNodes...))
+	} else {
+		nodes = available
+	}
+	nodes = nearestNodes(nodes, s.Opts.Nearest)
 
 	var loadBalanceType string
 	if o.LoadBalanceType != "" {
 		loadBalanceType = o.LoadBalanceType
+	} else if target.LoadBalancer != "" {
+		loadBalanceType = target.LoadBalancer
+	} else if so.LoadBalancer != "" {
+		loadBalanceType = so.LoadBalancer
 	} else {
 		loadBalanceType = s.Opts.LoadBalancer
 	}
@@ -78,10 +151,62 @@ func (s *Selector) Select(serviceName string, opts ...tselector.Option) (node *t
 		loadbalance.WithKey(o.Key),
 		loadbalance.WithNamespace(o.Namespace),
 	}
-	return load.Select(serviceName, nodes, loadBalanceOpts...)
+	node, err = load.Select(serviceName, nodes, loadBalanceOpts...)
+	if err == nil && breakers != nil {
+		breakers.selected(node)
+	}
+	return node, err
+}
+
+// discovery returns the discovery looking up the nodes.
+func (s *Selector) discovery() *discovery.Discovery {
+	if s.Opts.Discovery != nil {
+		return s.Opts.Discovery
+	}
+	return discovery.DefaultDiscovery
 }
 
-// Report for reporting the information.
+// list lists the nodes of the service, the unhealthy nodes are listed only if they are needed. All the nodes are
+// returned as healthy if the healthy ratio is below the panic threshold.
+func (s *Selector) list(serviceName string, so *ServiceOptions,
+	o *tselector.Options) (nodes, unhealthyNodes []*tregistry.Node, err error) {
+	d := s.discovery()
+	if so.PanicThreshold <= 0 && s.locality == nil {
+		nodes, err = d.List(serviceName, tdiscovery.WithContext(o.Ctx))
+		return nodes, nil, err
+	}
+	nodes, unhealthyNodes, err = d.ListAll(serviceName, tdiscovery.WithContext(o.Ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	if panicking(len(nodes), len(unhealthyNodes), so.PanicThreshold) {
+		log.Debugf("consul selector panics, %d of %d nodes of service %s are healthy, select among all the nodes",
+			len(nodes), len(nodes)+len(unhealthyNodes), serviceName)
+		all := make([]*tregistry.Node, 0, len(nodes)+len(unhealthyNodes))
+		nodes = append(append(all, nodes...), unhealthyNodes...)
+		unhealthyNodes = nil
+	}
+	if len(nodes) == 0 {
+		if len(unhealthyNodes) == 0 {
+			return nil, nil, consul_error.ServiceNotFoundError
+		}
+		return nil, nil, consul_error.ServerNotAvailableError
+	}
+	return nodes, unhealthyNodes, nil
+}
+
+// Report for reporting the information, the result feeds the circuit breaker, the outlier detection
+// and the p2c balancer.
 func (s *Selector) Report(node *tregistry.Node, cost time.Duration, err error) error {
+	if node == nil {
+		return nil
+	}
+	if breakers := s.breakersOf(callee(node)); breakers != nil {
+		breakers.report(node, cost, err)
+	}
+	if s.outliers != nil {
+		s.outliers.report(node, cost, err)
+	}
+	defaultP2C.report(node, cost, err)
 	return nil
 }
@@ -39,12 +39,13 @@ func TestSelector_Select(t *testing.T) {
 		So(err, ShouldNotBeNil)
 		discovery.DefaultDiscovery = d
 
-		ApplyMethod(reflect.TypeOf(d), "List", func(d *discovery.Discovery,
+		patches := ApplyMethod(reflect.TypeOf(d), "List", func(d *discovery.Discovery,
 			service string, opt ...tdiscovery.Option) (nodes []*registry.Node, err error) {
 			return nil, nil
 		}).ApplyFunc(loadbalance.Get, func(name string) loadbalance.LoadBalancer {
 			return &loadbalance.Random{}
 		})
+		defer patches.Reset()
 
 		node, err := s.Select("service")
 		_ = s.Report(node, time.Second, err)
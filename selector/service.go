@@ -0,0 +1,146 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"fmt"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
+)
+
+// ServiceOptions the selector configuration of a callee, zero values use the global configuration.
+type ServiceOptions struct {
+	LoadBalancer string            // load balancing strategy
+	Tags         []string          // Only the nodes with all the tags are selected.
+	Metadata     map[string]string // Only the nodes with all the metadata are selected.
+	// PanicThreshold is the healthy ratio of the nodes, below which the health checks are not trusted and
+	// all the nodes are selected, including the unhealthy ones. 0 means never.
+	PanicThreshold float64
+	// CircuitBreaker configuration of the callee, nil means the global one.
+	CircuitBreaker *CircuitBreakerOptions
+	// DisableCircuitBreaker disables the global circuit breaker for the callee.
+	DisableCircuitBreaker bool
+}
+
+// defaultServiceOptions is used by the callees without their own configuration.
+var defaultServiceOptions = &ServiceOptions{}
+
+// serviceOptions returns the configuration of the callee.
+func (s *Selector) serviceOptions(serviceName string) *ServiceOptions {
+	if so := s.Opts.Services[serviceName]; so != nil {
+		return so
+	}
+	return defaultServiceOptions
+}
+
+// breakersOf returns the circuit breakers of the callee, nil if it has none.
+func (s *Selector) breakersOf(serviceName string) *circuitBreakers {
+	if b, ok := s.serviceBreakers[serviceName]; ok {
+		return b
+	}
+	return s.breakers
+}
+
+// callee returns the callee name the node is selected by, which is the service name of the target without
+// the query parameters, so that the node is reported to the same circuit breakers it is selected by.
+func callee(node *tregistry.Node) string {
+	if name, ok := node.Metadata[discovery.MetaCallee].(string); ok && name != "" {
+		return name
+	}
+	return node.ServiceName
+}
+
+// panicking reports whether the healthy ratio of the nodes is below the panic threshold.
+func panicking(healthy, unhealthy int, threshold float64) bool {
+	if threshold <= 0 || unhealthy == 0 {
+		return false
+	}
+	return float64(healthy)/float64(healthy+unhealthy) < threshold
+}
+
+// filterNodes keeps the nodes with all the tags and metadata of the callee configuration,
+// NoMatchedNodeError is returned if none matches.
+func filterNodes(nodes []*tregistry.Node, so *ServiceOptions) ([]*tregistry.Node, error) {
+	if len(so.Tags) == 0 && len(so.Metadata) == 0 {
+		return nodes, nil
+	}
+	matched := matchNodes(nodes, so)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("%w: tags %v, metadata %v", consul_error.NoMatchedNodeError, so.Tags, so.Metadata)
+	}
+	return matched, nil
+}
+
+// matchNodes returns the nodes with all the tags and metadata of the callee configuration.
+func matchNodes(nodes []*tregistry.Node, so *ServiceOptions) []*tregistry.Node {
+	if len(so.Tags) == 0 && len(so.Metadata) == 0 {
+		return nodes
+	}
+	matched := make([]*tregistry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if hasTags(node, so.Tags) && hasMetadata(node, so.Metadata) {
+			matched = append(matched, node)
+		}
+	}
+	return matched
+}
+
+// ejectedNodes returns the nodes removed from the nodes by a filter keeping the order of them.
+func ejectedNodes(nodes, kept []*tregistry.Node) []*tregistry.Node {
+	if len(kept) == len(nodes) {
+		return nil
+	}
+	var ejected []*tregistry.Node
+	for _, node := range nodes {
+		if len(kept) > 0 && kept[0] == node {
+			kept = kept[1:]
+			continue
+		}
+		ejected = append(ejected, node)
+	}
+	return ejected
+}
+
+// hasTags reports whether the node has all the tags.
+func hasTags(node *tregistry.Node, tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	nodeTags, _ := node.Metadata[discovery.MetaTags].([]string)
+	for _, tag := range tags {
+		found := false
+		for _, t := range nodeTags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMetadata reports whether the node has all the metadata.
+func hasMetadata(node *tregistry.Node, metadata map[string]string) bool {
+	for key, value := range metadata {
+		if v, _ := node.Metadata[key].(string); v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+	consul_error "trpc.group/trpc-go/trpc-naming-consul/error"
+)
+
+func Test_filterNodes(t *testing.T) {
+	Convey("按tag和metadata过滤节点", t, func() {
+		nodes := newTestNodes("test", "a", "b", "c")
+		nodes[0].Metadata[discovery.MetaTags] = []string{"v1", "canary"}
+		nodes[1].Metadata[discovery.MetaTags] = []string{"v2", "canary"}
+		nodes[1].Metadata["set"] = "sz"
+		nodes[2].Metadata[discovery.MetaTags] = []string{"v2"}
+
+		matched, err := filterNodes(nodes, &ServiceOptions{})
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 3)
+		matched, err = filterNodes(nodes, &ServiceOptions{Tags: []string{"canary"}})
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 2)
+		matched, err = filterNodes(nodes, &ServiceOptions{Tags: []string{"v2"}, Metadata: map[string]string{"set": "sz"}})
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 1)
+		So(matched[0].Address, ShouldEqual, "b")
+		_, err = filterNodes(nodes, &ServiceOptions{Tags: []string{"v3"}})
+		So(errors.Is(err, consul_error.NoMatchedNodeError), ShouldBeTrue)
+	})
+	Convey("健康节点比例低于恐慌阈值", t, func() {
+		So(panicking(1, 3, 0), ShouldBeFalse)
+		So(panicking(1, 3, 0.5), ShouldBeTrue)
+		So(panicking(2, 2, 0.5), ShouldBeFalse)
+		So(panicking(3, 0, 0.5), ShouldBeFalse)
+		So(panicking(0, 3, 0.5), ShouldBeTrue)
+	})
+}
+
+func TestSelector_services(t *testing.T) {
+	healthy := newTestNodes("test", "a")
+	unhealthy := newTestNodes("test", "b", "c", "d")
+	d := &discovery.Discovery{}
+	discovery.DefaultDiscovery = d
+	patches := ApplyMethod(reflect.TypeOf(d), "ListAll", func(d *discovery.Discovery,
+		service string, opt ...tdiscovery.Option) ([]*tregistry.Node, []*tregistry.Node, error) {
+		return healthy, unhealthy, nil
+	}).ApplyMethod(reflect.TypeOf(d), "List", func(d *discovery.Discovery,
+		service string, opt ...tdiscovery.Option) ([]*tregistry.Node, error) {
+		return healthy, nil
+	})
+	defer patches.Reset()
+
+	Convey("恐慌阈值下选取所有节点", t, func() {
+		s := New(WithServices(map[string]*ServiceOptions{"test": {PanicThreshold: 0.5}}))
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			seen[node.Address] = true
+		}
+		So(len(seen), ShouldBeGreaterThan, 1)
+		// Other callees use the global configuration.
+		for i := 0; i < 10; i++ {
+			node, err := s.Select("other")
+			So(err, ShouldBeNil)
+			So(node.Address, ShouldEqual, "a")
+		}
+	})
+	Convey("被调的负载均衡策略", t, func() {
+		s := New(WithServices(map[string]*ServiceOptions{"test": {LoadBalancer: "unknown"}}))
+		_, err := s.Select("test")
+		So(err, ShouldEqual, consul_error.BalancerNotExistError)
+		_, err = s.Select("other")
+		So(err, ShouldBeNil)
+	})
+	Convey("被调的熔断配置", t, func() {
+		callErr := errors.New("timeout")
+		s := New(WithCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1, RecoveryWindow: time.Hour}),
+			WithServices(map[string]*ServiceOptions{
+				"test":     {CircuitBreaker: &CircuitBreakerOptions{ConsecutiveFailures: 3, RecoveryWindow: time.Hour}},
+				"disabled": {DisableCircuitBreaker: true},
+			}))
+		So(s.breakersOf("test"), ShouldNotEqual, s.breakers)
+		So(s.breakersOf("disabled"), ShouldBeNil)
+		So(s.breakersOf("other"), ShouldEqual, s.breakers)
+
+		node := newTestNodes("test", "a")[0]
+		_ = s.Report(node, time.Millisecond, callErr)
+		So(len(s.breakersOf("test").filter(healthy)), ShouldEqual, 1)
+		other := newTestNodes("other", "a")[0]
+		_ = s.Report(other, time.Millisecond, callErr)
+		So(len(s.breakers.filter(newTestNodes("other", "a", "b"))), ShouldEqual, 1)
+	})
+}
+
+func TestSelector_target(t *testing.T) {
+	d := &discovery.Discovery{}
+	discovery.DefaultDiscovery = d
+	patches := ApplyMethod(reflect.TypeOf(d), "List", func(d *discovery.Discovery,
+		service string, opt ...tdiscovery.Option) ([]*tregistry.Node, error) {
+		return newTestNodes("test", "a"), nil
+	})
+	defer patches.Reset()
+
+	Convey("服务名参数中的负载均衡策略", t, func() {
+		s := New(WithServices(map[string]*ServiceOptions{"test": {LoadBalancer: "random"}}))
+		_, err := s.Select("test?lb=unknown")
+		So(err, ShouldEqual, consul_error.BalancerNotExistError)
+		node, err := s.Select("test?lb=random")
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "a")
+		_, err = s.Select("test?unknown=1")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// newTestEntry creates a consul service entry of the service test with the check status.
+func newTestEntry(port int, status string, meta map[string]string) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Service: &api.AgentService{ID: strconv.Itoa(port), Service: "test", Address: "8.8.8.8", Port: port,
+			Meta: meta, Weights: api.AgentWeights{Passing: 10, Warning: 1}},
+		Checks: api.HealthChecks{&api.HealthCheck{Status: status}},
+	}
+}
+
+// newTestDiscovery creates a discovery whose consul returns the entries, call the returned function to close it.
+func newTestDiscovery(entries ...*api.ServiceEntry) (*discovery.Discovery, func()) {
+	c, err := api.NewClient(api.DefaultConfig())
+	So(err, ShouldBeNil)
+	patches := ApplyMethod(reflect.TypeOf(c.Health()), "Service", func(h *api.Health, service, tag string,
+		passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		return entries, &api.QueryMeta{LastIndex: 1}, nil
+	})
+	d, err := discovery.New(discovery.WithClient(c), discovery.WithInitialSyncTimeout(time.Minute))
+	So(err, ShouldBeNil)
+	return d, func() {
+		_ = d.Close(context.Background())
+		patches.Reset()
+	}
+}
+
+func TestSelector_panicThreshold(t *testing.T) {
+	Convey("健康节点比例低于恐慌阈值时在全部节点中选取", t, func() {
+		d, closeDiscovery := newTestDiscovery(
+			newTestEntry(1000, api.HealthPassing, nil),
+			newTestEntry(1001, api.HealthCritical, nil),
+			newTestEntry(1002, api.HealthCritical, nil),
+			newTestEntry(1003, api.HealthCritical, nil),
+		)
+		defer closeDiscovery()
+
+		selected := func(s *Selector) map[string]bool {
+			seen := make(map[string]bool)
+			for i := 0; i < 200; i++ {
+				node, err := s.Select("test")
+				So(err, ShouldBeNil)
+				seen[node.Address] = true
+			}
+			return seen
+		}
+		So(len(selected(New(WithDiscovery(d)))), ShouldEqual, 1)
+		s := New(WithDiscovery(d), WithServices(map[string]*ServiceOptions{"test": {PanicThreshold: 0.5}}))
+		So(len(selected(s)), ShouldEqual, 4)
+	})
+}
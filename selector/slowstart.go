@@ -0,0 +1,170 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// Curves of the slow start.
+const (
+	// SlowStartLinear ramps the weight up linearly.
+	SlowStartLinear = "linear"
+	// SlowStartExponential ramps the weight up exponentially, slowly at first and quickly at last.
+	SlowStartExponential = "exponential"
+)
+
+const (
+	defaultSlowStartMinWeightRatio = 0.1
+	// slowStartWeightScale scales the weights of all the nodes while some are warming up,
+	// so that the small integer weights can be ramped up smoothly.
+	slowStartWeightScale = 100
+)
+
+// SlowStartOptions slow start configuration, zero values are replaced by the defaults.
+type SlowStartOptions struct {
+	// Window is how long a new node takes to ramp up to its full weight.
+	Window time.Duration
+	// MinWeightRatio is the ratio of the full weight a new node starts from, 0.1 by default.
+	MinWeightRatio float64
+	// Curve is how the weight ramps up, SlowStartLinear by default.
+	Curve string
+}
+
+// Check checks the slow start configuration.
+func (o *SlowStartOptions) Check() error {
+	if o.Window <= 0 {
+		return fmt.Errorf("slow start window %s is not positive", o.Window)
+	}
+	switch o.Curve {
+	case "", SlowStartLinear, SlowStartExponential:
+		return nil
+	default:
+		return fmt.Errorf("unknown slow start curve %s", o.Curve)
+	}
+}
+
+// slowStartService tracks the nodes of a service, the nodes are compared only when the nodes listed change.
+type slowStartService struct {
+	// The nodes listed last time, discovery converts new nodes on every change rather than modifying them.
+	first *tregistry.Node
+	count int
+	// The time each node was first seen, zero for the nodes known when the service was first seen.
+	firstSeen map[string]time.Time
+	// The time the last node finishes warming up.
+	warmUntil time.Time
+}
+
+// slowStart ramps the weights of new nodes up from a floor to their full weights in the window.
+type slowStart struct {
+	opts SlowStartOptions
+
+	mu       sync.Mutex
+	services map[string]*slowStartService
+}
+
+// newSlowStart creates the slow start.
+func newSlowStart(opts SlowStartOptions) *slowStart {
+	if opts.MinWeightRatio <= 0 || opts.MinWeightRatio > 1 {
+		opts.MinWeightRatio = defaultSlowStartMinWeightRatio
+	}
+	if opts.Curve == "" {
+		opts.Curve = SlowStartLinear
+	}
+	return &slowStart{opts: opts, services: make(map[string]*slowStartService)}
+}
+
+// weigh returns the nodes with the weights of the new nodes ramped down, the nodes are copied if some are
+// warming up, so that the nodes of discovery are not modified.
+func (s *slowStart) weigh(serviceName string, nodes []*tregistry.Node) []*tregistry.Node {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	now := time.Now()
+	s.mu.Lock()
+	service := s.trackLocked(serviceName, nodes, now)
+	if !now.Before(service.warmUntil) {
+		s.mu.Unlock()
+		return nodes
+	}
+	ratios := make([]float64, len(nodes))
+	for i, node := range nodes {
+		ratios[i] = s.ratio(now.Sub(service.firstSeen[node.Address]))
+	}
+	s.mu.Unlock()
+
+	weighed := make([]*tregistry.Node, len(nodes))
+	for i, node := range nodes {
+		n := *node
+		weight := node.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		n.Weight = int(math.Ceil(float64(weight*slowStartWeightScale) * ratios[i]))
+		weighed[i] = &n
+	}
+	return weighed
+}
+
+// trackLocked updates the first seen time of the nodes if the nodes change.
+func (s *slowStart) trackLocked(serviceName string, nodes []*tregistry.Node, now time.Time) *slowStartService {
+	service, ok := s.services[serviceName]
+	if ok && service.first == nodes[0] && service.count == len(nodes) {
+		return service
+	}
+	firstSeen := make(map[string]time.Time, len(nodes))
+	for _, node := range nodes {
+		seen, known := time.Time{}, !ok
+		if ok {
+			seen, known = service.firstSeen[node.Address]
+		}
+		if !known {
+			seen = now
+		}
+		firstSeen[node.Address] = seen
+	}
+	if !ok {
+		service = &slowStartService{}
+		s.services[serviceName] = service
+	}
+	service.first, service.count, service.firstSeen = nodes[0], len(nodes), firstSeen
+	service.warmUntil = time.Time{}
+	for _, seen := range firstSeen {
+		if until := seen.Add(s.opts.Window); until.After(service.warmUntil) {
+			service.warmUntil = until
+		}
+	}
+	return service
+}
+
+// ratio returns the ratio of the full weight of a node seen for the duration.
+func (s *slowStart) ratio(seen time.Duration) float64 {
+	if seen >= s.opts.Window {
+		return 1
+	}
+	if seen < 0 {
+		seen = 0
+	}
+	progress := float64(seen) / float64(s.opts.Window)
+	min := s.opts.MinWeightRatio
+	if s.opts.Curve == SlowStartExponential {
+		return math.Pow(min, 1-progress)
+	}
+	return min + (1-min)*progress
+}
@@ -0,0 +1,66 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/glycerine/goconvey/convey"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+func Test_slowStart(t *testing.T) {
+	Convey("检查慢启动配置", t, func() {
+		So((&SlowStartOptions{}).Check(), ShouldNotBeNil)
+		So((&SlowStartOptions{Window: time.Minute, Curve: "unknown"}).Check(), ShouldNotBeNil)
+		So((&SlowStartOptions{Window: time.Minute, Curve: SlowStartExponential}).Check(), ShouldBeNil)
+	})
+	Convey("权重比例", t, func() {
+		s := newSlowStart(SlowStartOptions{Window: 10 * time.Second})
+		So(s.ratio(0), ShouldEqual, defaultSlowStartMinWeightRatio)
+		So(s.ratio(5*time.Second), ShouldAlmostEqual, 0.55)
+		So(s.ratio(time.Minute), ShouldEqual, 1)
+		s = newSlowStart(SlowStartOptions{Window: 10 * time.Second, MinWeightRatio: 0.01, Curve: SlowStartExponential})
+		So(s.ratio(0), ShouldAlmostEqual, 0.01)
+		So(s.ratio(5*time.Second), ShouldAlmostEqual, 0.1)
+		So(s.ratio(10*time.Second), ShouldEqual, 1)
+	})
+	Convey("新节点权重逐渐增加", t, func() {
+		s := newSlowStart(SlowStartOptions{Window: time.Hour})
+		nodes := newTestNodes("test", "a", "b")
+		// The nodes known at first are warm.
+		So(s.weigh("test", nodes), ShouldResemble, nodes)
+		So(s.weigh("test", nodes), ShouldResemble, nodes)
+
+		updated := append(newTestNodes("test", "a", "b"), newTestNodes("test", "c")...)
+		weighed := s.weigh("test", updated)
+		So(weighed[0].Weight, ShouldEqual, 10*slowStartWeightScale)
+		So(weighed[1].Weight, ShouldEqual, 10*slowStartWeightScale)
+		So(weighed[2].Weight, ShouldBeBetween, 10*slowStartWeightScale/10-1, 10*slowStartWeightScale/10+2)
+		// The nodes of discovery are not modified.
+		So(updated[2].Weight, ShouldEqual, 10)
+
+		// The node warms up after the window.
+		s.services["test"].firstSeen["c"] = time.Now().Add(-time.Hour)
+		s.services["test"].warmUntil = time.Now()
+		So(s.weigh("test", updated), ShouldResemble, updated)
+
+		// A node removed and added again warms up again.
+		s.weigh("test", updated[:2])
+		weighed = s.weigh("test", append(newTestNodes("test", "a", "b"), newTestNodes("test", "c")...))
+		So(weighed[2].Weight, ShouldBeLessThan, 10*slowStartWeightScale)
+		So(s.weigh("test", []*tregistry.Node{}), ShouldBeEmpty)
+	})
+}
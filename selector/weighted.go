@@ -0,0 +1,146 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"sync"
+
+	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// Names of the weighted balancers registered in loadbalance.
+const (
+	// LoadBalanceWeightedRandom selects nodes randomly in proportion to their weights, it is the default
+	// of the selector, which is the same as random if the weights are the same.
+	LoadBalanceWeightedRandom = "weighted_random"
+	// LoadBalanceSmoothWeightedRoundRobin selects nodes in turn in proportion to their weights, and spreads
+	// the selections of a node evenly.
+	LoadBalanceSmoothWeightedRoundRobin = "smooth_weighted_round_robin"
+)
+
+func init() {
+	loadbalance.Register(LoadBalanceWeightedRandom, newWeightedRandom())
+	loadbalance.Register(LoadBalanceSmoothWeightedRoundRobin, newSmoothWeightedRoundRobin())
+}
+
+// nodeWeight returns the weight of the node used by the weighted balancers, 0 for negative weights.
+func nodeWeight(node *tregistry.Node) int {
+	if node.Weight < 0 {
+		return 0
+	}
+	return node.Weight
+}
+
+// weightedRandom selects nodes randomly in proportion to their weights, the nodes are selected uniformly
+// if all their weights are 0.
+type weightedRandom struct {
+	rand *safeRand
+}
+
+// newWeightedRandom creates the weighted random balancer.
+func newWeightedRandom() *weightedRandom {
+	return &weightedRandom{rand: newSafeRand()}
+}
+
+// Select selects a node randomly in proportion to the weights.
+func (w *weightedRandom) Select(serviceName string, list []*tregistry.Node,
+	opts ...loadbalance.Option) (*tregistry.Node, error) {
+	return selectUnbanned(list, opts, w.choose)
+}
+
+// choose chooses a node randomly in proportion to the weights.
+func (w *weightedRandom) choose(nodes []*tregistry.Node) *tregistry.Node {
+	total := 0
+	for _, node := range nodes {
+		total += nodeWeight(node)
+	}
+	if total <= 0 {
+		return nodes[w.rand.Intn(len(nodes))]
+	}
+	r := w.rand.Intn(total)
+	for _, node := range nodes {
+		if r -= nodeWeight(node); r < 0 {
+			return node
+		}
+	}
+	return nodes[len(nodes)-1]
+}
+
+// smoothWeightedRoundRobin is the smooth weighted round robin of nginx. Each selection adds the weights to
+// the current weights of the nodes, selects the node with the max current weight and subtracts the total
+// weight from it, so that a node with a large weight is not selected in a row.
+type smoothWeightedRoundRobin struct {
+	services sync.Map // service name -> *swrrService
+}
+
+// swrrService is the current weights of the nodes of a service.
+type swrrService struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+// newSmoothWeightedRoundRobin creates the smooth weighted round robin balancer.
+func newSmoothWeightedRoundRobin() *smoothWeightedRoundRobin {
+	return &smoothWeightedRoundRobin{}
+}
+
+// Select selects a node by the smooth weighted round robin of the service.
+func (s *smoothWeightedRoundRobin) Select(serviceName string, list []*tregistry.Node,
+	opts ...loadbalance.Option) (*tregistry.Node, error) {
+	v, ok := s.services.Load(serviceName)
+	if !ok {
+		v, _ = s.services.LoadOrStore(serviceName, &swrrService{current: make(map[string]int)})
+	}
+	return selectUnbanned(list, opts, v.(*swrrService).choose)
+}
+
+// choose chooses the node with the max current weight, the nodes with 0 weights are selected only if all
+// the weights are 0.
+func (s *swrrService) choose(nodes []*tregistry.Node) *tregistry.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		best  *tregistry.Node
+		total int
+	)
+	for _, node := range nodes {
+		weight := nodeWeight(node)
+		if weight == 0 {
+			continue
+		}
+		s.current[node.Address] += weight
+		total += weight
+		if best == nil || s.current[node.Address] > s.current[best.Address] {
+			best = node
+		}
+	}
+	if best == nil {
+		best = nodes[0]
+	}
+	s.current[best.Address] -= total
+	// Drop the current weights of the nodes gone.
+	if len(s.current) > len(nodes) {
+		present := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			present[node.Address] = true
+		}
+		for address := range s.current {
+			if !present[address] {
+				delete(s.current, address)
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,132 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 THL A29 Limited, a Tencent company.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/agiledragon/gomonkey"
+	. "github.com/glycerine/goconvey/convey"
+	"github.com/hashicorp/consul/api"
+	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-consul/discovery"
+)
+
+func newWeightedNodes(weights ...int) []*tregistry.Node {
+	addresses := []string{"a", "b", "c", "d"}[:len(weights)]
+	nodes := newTestNodes("test", addresses...)
+	for i, weight := range weights {
+		nodes[i].Weight = weight
+	}
+	return nodes
+}
+
+func Test_weightedRandom(t *testing.T) {
+	Convey("注册带权重的负载均衡并作为默认策略", t, func() {
+		So(loadbalance.Get(LoadBalanceWeightedRandom), ShouldNotBeNil)
+		So(loadbalance.Get(LoadBalanceSmoothWeightedRoundRobin), ShouldNotBeNil)
+		So(New().Opts.LoadBalancer, ShouldEqual, LoadBalanceWeightedRandom)
+	})
+	Convey("按权重随机选取", t, func() {
+		w := newWeightedRandom()
+		nodes := newWeightedNodes(1, 3, 0)
+		counts := map[string]int{}
+		for i := 0; i < 8000; i++ {
+			node, err := w.Select("test", nodes)
+			So(err, ShouldBeNil)
+			counts[node.Address]++
+		}
+		So(counts["a"], ShouldBeBetween, 1700, 2300)
+		So(counts["b"], ShouldBeBetween, 5700, 6300)
+		So(counts["c"], ShouldEqual, 0)
+
+		// All the weights are 0.
+		counts = map[string]int{}
+		for i := 0; i < 100; i++ {
+			node, _ := w.Select("test", newWeightedNodes(0, 0))
+			counts[node.Address]++
+		}
+		So(len(counts), ShouldEqual, 2)
+		_, err := w.Select("test", nil)
+		So(err, ShouldEqual, loadbalance.ErrNoServerAvailable)
+	})
+}
+
+func Test_smoothWeightedRoundRobin(t *testing.T) {
+	Convey("平滑加权轮询", t, func() {
+		s := newSmoothWeightedRoundRobin()
+		nodes := newWeightedNodes(5, 1, 1)
+		var sequence string
+		for i := 0; i < 7; i++ {
+			node, err := s.Select("test", nodes)
+			So(err, ShouldBeNil)
+			sequence += node.Address
+		}
+		So(sequence, ShouldEqual, "aabacaa")
+
+		// The current weights of the nodes gone are dropped.
+		_, _ = s.Select("test", nodes[:1])
+		v, _ := s.services.Load("test")
+		So(len(v.(*swrrService).current), ShouldEqual, 1)
+		node, _ := s.Select("test", newWeightedNodes(0))
+		So(node.Address, ShouldEqual, "a")
+		_, err := s.Select("test", nil)
+		So(err, ShouldEqual, loadbalance.ErrNoServerAvailable)
+	})
+}
+
+func TestSelector_warningWeight(t *testing.T) {
+	Convey("warning节点使用warning权重参与负载均衡", t, func() {
+		entry := func(id string, port int, status string) *api.ServiceEntry {
+			return &api.ServiceEntry{
+				Service: &api.AgentService{ID: id, Service: "test", Address: "8.8.8.8", Port: port,
+					Weights: api.AgentWeights{Passing: 10, Warning: 1}},
+				Checks: api.HealthChecks{&api.HealthCheck{Status: status}},
+			}
+		}
+		c, err := api.NewClient(api.DefaultConfig())
+		So(err, ShouldBeNil)
+		patches := ApplyMethod(reflect.TypeOf(c.Health()), "Service", func(h *api.Health, service, tag string,
+			passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			return []*api.ServiceEntry{
+				entry("passing", 1000, api.HealthPassing),
+				entry("warning", 1001, api.HealthWarning),
+				entry("critical", 1002, api.HealthCritical),
+			}, &api.QueryMeta{LastIndex: 1}, nil
+		})
+		defer patches.Reset()
+		d, err := discovery.New(discovery.WithClient(c), discovery.WithInitialSyncTimeout(time.Minute))
+		So(err, ShouldBeNil)
+		defer func() { _ = d.Close(context.Background()) }()
+
+		nodes, err := d.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 2)
+
+		s := New(WithDiscovery(d))
+		counts := map[string]int{}
+		for i := 0; i < 5500; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			counts[node.Address]++
+		}
+		So(counts["8.8.8.8:1000"], ShouldBeBetween, 4700, 5300)
+		So(counts["8.8.8.8:1001"], ShouldBeBetween, 200, 800)
+		So(counts["8.8.8.8:1002"], ShouldEqual, 0)
+	})
+}